@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
 	"github.com/pboehm/ddns/shared"
 	"log"
@@ -19,7 +20,8 @@ func NewBackend(config *shared.Config, lookup *HostLookup) *Backend {
 	}
 }
 
-func (b *Backend) Run() error {
+// Run serves the PowerDNS remote backend until the context is canceled
+func (b *Backend) Run(ctx context.Context) error {
 	r := gin.New()
 	r.Use(gin.Recovery())
 
@@ -33,20 +35,84 @@ func (b *Backend) Run() error {
 			QType: c.Param("qtype"),
 		}
 
-		response, err := b.lookup.Lookup(request)
+		responses, err := b.lookup.Lookup(c.Request.Context(), request)
 		if err == nil {
 			c.JSON(200, gin.H{
-				"result": []*Response{response},
+				"result": responses,
 			})
 		} else {
 			if b.config.Verbose {
 				log.Printf("Error during lookup: %v", err)
 			}
 
+			c.JSON(resultCode(err), gin.H{
+				"result": false,
+			})
+		}
+	})
+
+	r.Any("/dnsapi/initialize", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"result": true,
+		})
+	})
+
+	r.GET("/dnsapi/list/:id/:zonename", func(c *gin.Context) {
+		zone := b.config.GetZone(c.Param("zonename"))
+		if zone == nil {
+			c.JSON(200, gin.H{
+				"result": false,
+			})
+			return
+		}
+
+		responses, err := b.lookup.List(c.Request.Context(), zone)
+		if err != nil {
+			if b.config.Verbose {
+				log.Printf("Error during list: %v", err)
+			}
+
+			c.JSON(resultCode(err), gin.H{
+				"result": false,
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"result": responses,
+		})
+	})
+
+	r.GET("/dnsapi/getDomainInfo/:name", func(c *gin.Context) {
+		zone := b.config.GetZone(c.Param("name"))
+		if zone == nil {
 			c.JSON(200, gin.H{
 				"result": false,
 			})
+			return
 		}
+
+		c.JSON(200, gin.H{
+			"result": b.domainInfo(c.Request.Context(), zone),
+		})
+	})
+
+	r.GET("/dnsapi/getAllDomains", func(c *gin.Context) {
+		domains := []gin.H{}
+		for _, zone := range b.config.Zones {
+			domains = append(domains, b.domainInfo(c.Request.Context(), zone))
+		}
+
+		c.JSON(200, gin.H{
+			"result": domains,
+		})
+	})
+
+	r.GET("/dnsapi/getUpdatedMasters", func(c *gin.Context) {
+		// our zones are of kind native, so there are no notifications to send
+		c.JSON(200, gin.H{
+			"result": []gin.H{},
+		})
 	})
 
 	r.GET("/dnsapi/getDomainMetadata/:name/:kind", func(c *gin.Context) {
@@ -61,5 +127,39 @@ func (b *Backend) Run() error {
 		})
 	})
 
-	return r.Run(b.config.ListenBackend)
+	return shared.ListenAndServe(ctx, b.config.ListenBackend, r)
+}
+
+// domainInfo describes the zone in the format used by getDomainInfo
+func (b *Backend) domainInfo(ctx context.Context, zone *shared.Zone) gin.H {
+	id := 0
+	for i, z := range b.config.Zones {
+		if z == zone {
+			id = i + 1
+		}
+	}
+
+	// an unknown serial forces PowerDNS to check the zone again
+	serial, err := b.lookup.hosts.GetSerial(ctx, zone.Name)
+	if err != nil && b.config.Verbose {
+		log.Printf("Error while getting the serial of %s: %v", zone.Name, err)
+	}
+
+	return gin.H{
+		"id":     id,
+		"zone":   zone.Name + ".",
+		"kind":   "native",
+		"serial": serial,
+	}
+}
+
+// resultCode returns the status code of a failed request. An unavailable host
+// storage results in a server error, which PowerDNS answers with SERVFAIL
+// instead of NXDOMAIN.
+func resultCode(err error) int {
+	if err == shared.ErrUnavailable {
+		return 500
+	}
+
+	return 200
 }
@@ -0,0 +1,230 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/pboehm/ddns/shared"
+	"golang.org/x/sync/errgroup"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// ednsBufferSize is the UDP payload size we announce to EDNS0 capable clients
+const ednsBufferSize = 1232
+
+// lookupTimeout bounds the time spent on answering a query, which is answered
+// with SERVFAIL afterwards, so that resolvers can retry in time
+const lookupTimeout = 2 * time.Second
+
+// DNSServer is an authoritative DNS server that answers queries for our zones
+// directly over UDP and TCP, so that running PowerDNS is optional
+type DNSServer struct {
+	config *shared.Config
+	lookup *HostLookup
+}
+
+func NewDNSServer(config *shared.Config, lookup *HostLookup) *DNSServer {
+	return &DNSServer{
+		config: config,
+		lookup: lookup,
+	}
+}
+
+// Run answers queries over UDP and TCP until the context is canceled or one
+// of the servers fails, which stops the other one and returns its error
+func (s *DNSServer) Run(ctx context.Context) error {
+	handler := dns.HandlerFunc(s.handleQuery)
+
+	// the sockets are opened upfront, so that an address in use is reported
+	// right away instead of leaving the other server running alone
+	packetConn, err := net.ListenPacket("udp", s.config.ListenDNS)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", s.config.ListenDNS)
+	if err != nil {
+		packetConn.Close()
+		return err
+	}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+
+	group.Go((&dns.Server{PacketConn: packetConn, Handler: handler}).ActivateAndServe)
+	group.Go((&dns.Server{Listener: listener, Handler: handler}).ActivateAndServe)
+
+	// the first failing server stops the other one by closing its socket, which
+	// also works if it has not been started yet, so that the error is returned
+	group.Go(func() error {
+		<-groupCtx.Done()
+		packetConn.Close()
+		listener.Close()
+		return nil
+	})
+
+	// the servers fail on the closed sockets after they have been stopped
+	if err := group.Wait(); err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *DNSServer) handleQuery(w dns.ResponseWriter, request *dns.Msg) {
+	remote := ""
+	if host, _, err := net.SplitHostPort(w.RemoteAddr().String()); err == nil {
+		remote = host
+	}
+
+	reply := s.buildReply(request, remote)
+
+	// answers over UDP have to fit into the buffer size of the client
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		size := dns.MinMsgSize
+		if opt := request.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		reply.Truncate(size)
+	}
+
+	if err := w.WriteMsg(reply); err != nil && s.config.Verbose {
+		log.Printf("Error while writing DNS reply: %v", err)
+	}
+}
+
+// buildReply answers the request using the HostLookup. Negative answers contain
+// the SOA record of the zone in the authority section.
+func (s *DNSServer) buildReply(request *dns.Msg, remote string) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(request)
+
+	if opt := request.IsEdns0(); opt != nil {
+		reply.SetEdns0(ednsBufferSize, false)
+
+		if opt.Version() != 0 {
+			reply.Rcode = dns.RcodeBadVers
+			return reply
+		}
+	}
+
+	if request.Opcode != dns.OpcodeQuery {
+		reply.Rcode = dns.RcodeNotImplemented
+		return reply
+	}
+
+	if len(request.Question) != 1 {
+		reply.Rcode = dns.RcodeFormatError
+		return reply
+	}
+
+	question := request.Question[0]
+	qname := strings.TrimSuffix(question.Name, ".")
+
+	zone := s.config.FindZone(qname)
+	if zone == nil {
+		reply.Rcode = dns.RcodeRefused
+		return reply
+	}
+
+	reply.Authoritative = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	lookupRequest := &Request{QName: qname, QType: dns.TypeToString[question.Qtype], Remote: remote}
+
+	responses, err := s.lookup.Lookup(ctx, lookupRequest)
+	if err != nil {
+		if s.config.Verbose {
+			log.Printf("Error during lookup: %v", err)
+		}
+
+		if err == shared.ErrUnavailable {
+			return serverFailure(reply)
+		}
+
+		reply.Rcode = dns.RcodeNameError
+	}
+
+	for _, response := range responses {
+		rr, err := responseToRR(question.Name, response)
+		if err != nil {
+			log.Printf("Could not convert %s record for %s: %v", response.QType, qname, err)
+			continue
+		}
+
+		reply.Answer = append(reply.Answer, rr)
+
+		if ns, ok := rr.(*dns.NS); ok {
+			if err = s.addGlue(ctx, reply, ns.Ns, remote); err == shared.ErrUnavailable {
+				return serverFailure(reply)
+			}
+		}
+	}
+
+	if len(reply.Answer) == 0 {
+		soa, err := s.soaRecord(ctx, zone, remote)
+		if err == shared.ErrUnavailable {
+			return serverFailure(reply)
+		} else if soa != nil {
+			reply.Ns = append(reply.Ns, soa)
+		}
+	}
+
+	return reply
+}
+
+// serverFailure turns the reply into a SERVFAIL, which is used when the host
+// storage is unavailable, so that resolvers do not cache a negative answer
+func serverFailure(reply *dns.Msg) *dns.Msg {
+	reply.Authoritative = false
+	reply.Rcode = dns.RcodeServerFailure
+	reply.Answer, reply.Ns = nil, nil
+	return reply
+}
+
+// addGlue adds the addresses of a nameserver within our zones to the
+// additional section, so that resolvers do not have to look them up
+func (s *DNSServer) addGlue(ctx context.Context, reply *dns.Msg, nameserver, remote string) error {
+	nameserver = strings.TrimSuffix(nameserver, ".")
+	if s.config.FindZone(nameserver) == nil {
+		return nil
+	}
+
+	for _, qtype := range []string{"A", "AAAA"} {
+		responses, err := s.lookup.Lookup(ctx, &Request{QName: nameserver, QType: qtype, Remote: remote})
+		if err == shared.ErrUnavailable {
+			return err
+		}
+
+		for _, response := range responses {
+			if response.QType != qtype {
+				continue
+			}
+
+			if rr, err := responseToRR(nameserver, response); err == nil {
+				reply.Extra = append(reply.Extra, rr)
+			}
+		}
+	}
+
+	return nil
+}
+
+// soaRecord returns the SOA record of the zone
+func (s *DNSServer) soaRecord(ctx context.Context, zone *shared.Zone, remote string) (dns.RR, error) {
+	responses, err := s.lookup.Lookup(ctx, &Request{QName: zone.Name, QType: "SOA", Remote: remote})
+	if err != nil || len(responses) == 0 {
+		return nil, err
+	}
+
+	return responseToRR(zone.Name, responses[0])
+}
+
+// responseToRR converts a response of the HostLookup into a resource record
+func responseToRR(name string, response *Response) (dns.RR, error) {
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), response.TTL, response.QType, response.Content))
+}
@@ -0,0 +1,224 @@
+package backend
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/pboehm/ddns/shared"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func buildDNSServer() *DNSServer {
+	config, _, lookup := buildLookup(".example.org")
+	return NewDNSServer(config, lookup)
+}
+
+func buildQuery(name string, qtype uint16) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	return query
+}
+
+func TestDNSServerAnswers(t *testing.T) {
+	server := buildDNSServer()
+
+	reply := server.buildReply(buildQuery("dual.example.org.", dns.TypeA), "")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.True(t, reply.Authoritative)
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, "10.10.10.11", reply.Answer[0].(*dns.A).A.String())
+	assert.Empty(t, reply.Ns)
+
+	reply = server.buildReply(buildQuery("dual.example.org.", dns.TypeANY), "")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 2)
+
+	reply = server.buildReply(buildQuery("example.org.", dns.TypeSOA), "")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, "dns.example.org.", reply.Answer[0].(*dns.SOA).Ns)
+}
+
+func TestDNSServerCNAMEAnswers(t *testing.T) {
+	server := buildDNSServer()
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeMX} {
+		reply := server.buildReply(buildQuery("alias.example.org.", qtype), "")
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assert.Len(t, reply.Answer, 1)
+		assert.Equal(t, "lb.cloud.example.net.", reply.Answer[0].(*dns.CNAME).Target)
+	}
+}
+
+func TestDNSServerMXAndSRVAnswers(t *testing.T) {
+	server := buildDNSServer()
+
+	reply := server.buildReply(buildQuery("mail.example.org.", dns.TypeMX), "")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 2)
+	assert.Equal(t, uint16(10), reply.Answer[0].(*dns.MX).Preference)
+	assert.Equal(t, "mail.example.org.", reply.Answer[0].(*dns.MX).Mx)
+
+	reply = server.buildReply(buildQuery("_sip._udp.mail.example.org.", dns.TypeSRV), "")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, uint16(5060), reply.Answer[0].(*dns.SRV).Port)
+	assert.Equal(t, "mail.example.org.", reply.Answer[0].(*dns.SRV).Target)
+
+	reply = server.buildReply(buildQuery("_xmpp._tcp.mail.example.org.", dns.TypeSRV), "")
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+}
+
+func TestDNSServerWildcardAnswers(t *testing.T) {
+	server := buildDNSServer()
+
+	reply := server.buildReply(buildQuery("app.proxy.example.org.", dns.TypeA), "")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, "app.proxy.example.org.", reply.Answer[0].Header().Name)
+	assert.Equal(t, "10.10.10.15", reply.Answer[0].(*dns.A).A.String())
+
+	reply = server.buildReply(buildQuery("app.www.example.org.", dns.TypeA), "")
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+}
+
+func TestDNSServerApexAnswers(t *testing.T) {
+	config, hosts, lookup := buildLookup(".example.org")
+	server := NewDNSServer(config, lookup)
+
+	reply := server.buildReply(buildQuery("iot.example.org.", dns.TypeA), "")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, "10.20.30.1", reply.Answer[0].(*dns.A).A.String())
+
+	// NODATA at the apex without addresses
+	reply = server.buildReply(buildQuery("example.org.", dns.TypeAAAA), "")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+	assert.Len(t, reply.Ns, 1)
+
+	// nameservers within our zones are returned together with their addresses
+	hosts.CreateHost(context.Background(), &shared.Host{
+		Zone:     "iot.example.org",
+		Hostname: "ns",
+		IPv4:     shared.Addresses{"10.20.30.2"},
+		IPv6:     shared.Addresses{"2001:db8::2"},
+	})
+
+	reply = server.buildReply(buildQuery("iot.example.org.", dns.TypeNS), "")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 2)
+	assert.Equal(t, "ns.iot.example.org.", reply.Answer[0].(*dns.NS).Ns)
+	assert.Equal(t, "ns2.example.net.", reply.Answer[1].(*dns.NS).Ns)
+	assert.Len(t, reply.Extra, 2)
+	assert.Equal(t, "ns.iot.example.org.", reply.Extra[0].Header().Name)
+	assert.Equal(t, "10.20.30.2", reply.Extra[0].(*dns.A).A.String())
+	assert.Equal(t, "2001:db8::2", reply.Extra[1].(*dns.AAAA).AAAA.String())
+
+	// nameservers without addresses are returned without glue
+	reply = server.buildReply(buildQuery("example.org.", dns.TypeNS), "")
+	assert.Len(t, reply.Answer, 1)
+	assert.Empty(t, reply.Extra)
+}
+
+func TestDNSServerNegativeAnswers(t *testing.T) {
+	server := buildDNSServer()
+
+	// NXDOMAIN for hosts that do not exist
+	reply := server.buildReply(buildQuery("notexisting.example.org.", dns.TypeA), "")
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+	assert.Len(t, reply.Ns, 1)
+	assert.Equal(t, dns.TypeSOA, reply.Ns[0].Header().Rrtype)
+
+	// NODATA for existing hosts without records of the requested type
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeMX, dns.TypeNS} {
+		reply = server.buildReply(buildQuery("v4.example.org.", qtype), "")
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assert.Empty(t, reply.Answer)
+		assert.Len(t, reply.Ns, 1)
+	}
+
+	reply = server.buildReply(buildQuery("example.net.", dns.TypeA), "")
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+	assert.False(t, reply.Authoritative)
+}
+
+func TestDNSServerEDNS0(t *testing.T) {
+	server := buildDNSServer()
+
+	query := buildQuery("www.example.org.", dns.TypeA)
+	query.SetEdns0(4096, false)
+
+	reply := server.buildReply(query, "")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.NotNil(t, reply.IsEdns0())
+	assert.Equal(t, uint16(ednsBufferSize), reply.IsEdns0().UDPSize())
+
+	query.IsEdns0().SetVersion(1)
+	reply = server.buildReply(query, "")
+	assert.Equal(t, dns.RcodeBadVers, reply.Rcode)
+
+	reply = server.buildReply(buildQuery("www.example.org.", dns.TypeA), "")
+	assert.Nil(t, reply.IsEdns0())
+}
+
+func TestDNSServerUnavailableBackend(t *testing.T) {
+	config, hosts, lookup := buildLookup(".example.org")
+	server := NewDNSServer(config, lookup)
+	hosts.unavailable = true
+
+	for _, name := range []string{"www.example.org.", "notexisting.example.org.", "example.org."} {
+		reply := server.buildReply(buildQuery(name, dns.TypeA), "")
+		assert.Equal(t, dns.RcodeServerFailure, reply.Rcode, name)
+		assert.Empty(t, reply.Answer)
+		assert.Empty(t, reply.Ns)
+	}
+}
+
+func TestDNSServerAddressInUse(t *testing.T) {
+	server := buildDNSServer()
+
+	// only the TCP port is taken, so the UDP server could be started alone
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server.config.ListenDNS = listener.Addr().String()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- server.Run(context.Background())
+	}()
+
+	select {
+	case err := <-result:
+		assert.NotNil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
+
+func TestDNSServerStops(t *testing.T) {
+	server := buildDNSServer()
+	server.config.ListenDNS = "127.0.0.1:0"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- server.Run(ctx)
+	}()
+
+	// canceling the context stops both servers without an error
+	cancel()
+
+	select {
+	case err := <-result:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
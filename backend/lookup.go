@@ -1,13 +1,15 @@
 package backend
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/pboehm/ddns/shared"
 	"strings"
-	"time"
 )
 
+const acmeChallengeLabel = "_acme-challenge."
+
 type Request struct {
 	QType      string
 	QName      string
@@ -33,64 +35,259 @@ func NewHostLookup(config *shared.Config, hostsBackend shared.HostBackend) *Host
 	return &HostLookup{config, hostsBackend}
 }
 
-func (l *HostLookup) Lookup(request *Request) (*Response, error) {
-	responseRecord := request.QType
-	responseContent := ""
+// Lookup answers the request with all matching records. An empty result means
+// that the name exists but has no records of the requested type, which also
+// applies to types we do not serve. The error is shared.ErrUnavailable if the
+// answer is unknown because of a failing storage.
+func (l *HostLookup) Lookup(ctx context.Context, request *Request) ([]*Response, error) {
+	zone := l.config.FindZone(request.QName)
+	if zone == nil {
+		return nil, errors.New("Query name does not correspond to our zones")
+	}
+
+	hostname, _ := zone.Hostname(request.QName)
+	if hostname == "" {
+		return l.apexRecords(ctx, request, zone)
+	}
 
-	switch request.QType {
-	case "SOA":
-		responseContent = fmt.Sprintf("%s. hostmaster%s. %d 1800 3600 7200 5",
-			l.config.SOAFqdn, l.config.Domain, l.currentSOASerial())
+	// TXT records for ACME challenges and SRV records live below the host they
+	// belong to
+	challenge := strings.HasPrefix(hostname, acmeChallengeLabel)
+	hostname = strings.TrimPrefix(hostname, acmeChallengeLabel)
+	service, hostname := splitService(hostname)
 
-	case "NS":
-		responseContent = l.config.SOAFqdn
+	// the protocol label of SRV records like _udp.pi exists as their parent,
+	// so that it has no records instead of not existing
+	if proto, owner := splitProto(hostname); service == "" && !challenge && proto != "" {
+		host, err := l.hosts.GetHost(ctx, zone.Name, owner)
+		if err == nil && host.SRV.HasProto(proto) {
+			return []*Response{}, nil
+		} else if err != nil && err != shared.ErrNotFound {
+			return nil, err
+		}
+	}
 
-	case "A", "AAAA", "ANY":
-		hostname, err := l.extractHostname(request.QName)
+	var host *shared.Host
+	var err error
+	if service != "" || challenge {
+		host, err = l.hosts.GetHost(ctx, zone.Name, hostname)
+	} else {
+		host, err = l.findHost(ctx, zone, hostname)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if service != "" {
+		return l.serviceRecords(request, host, service)
+	}
+
+	return l.hostRecords(request, host, challenge)
+}
+
+// apexRecords returns the records of the zone itself, which are the SOA and
+// NS records and the configured addresses
+func (l *HostLookup) apexRecords(ctx context.Context, request *Request, zone *shared.Zone) ([]*Response, error) {
+	responses := []*Response{}
+	all := request.QType == "ANY"
+
+	if request.QType == "SOA" || all {
+		serial, err := l.hosts.GetSerial(ctx, zone.Name)
 		if err != nil {
 			return nil, err
 		}
 
-		var host *shared.Host
-		if host, err = l.hosts.GetHost(hostname); err != nil {
+		content := fmt.Sprintf("%s. %s. %d %d %d %d %d",
+			zone.SOAFqdn, zone.Hostmaster, serial,
+			l.config.SOARefresh, l.config.SOARetry, l.config.SOAExpire, l.config.SOAMinimum)
+
+		responses = append(responses, l.buildResponse(request, "SOA", content, l.config.DefaultTTL))
+	}
+
+	if request.QType == "NS" || all {
+		for _, nameserver := range zone.Nameservers {
+			responses = append(responses, l.buildResponse(request, "NS", nameserver, l.config.DefaultTTL))
+		}
+	}
+
+	if request.QType == "A" || all {
+		for _, address := range zone.ApexIPv4 {
+			responses = append(responses, l.buildResponse(request, "A", address, l.config.DefaultTTL))
+		}
+	}
+
+	if request.QType == "AAAA" || all {
+		for _, address := range zone.ApexIPv6 {
+			responses = append(responses, l.buildResponse(request, "AAAA", address, l.config.DefaultTTL))
+		}
+	}
+
+	return responses, nil
+}
+
+// findHost returns the host with the hostname or, for names below a host like
+// app.pi, the closest host above it if it has the wildcard flag set
+func (l *HostLookup) findHost(ctx context.Context, zone *shared.Zone, hostname string) (*shared.Host, error) {
+	name := hostname
+	for {
+		host, err := l.hosts.GetHost(ctx, zone.Name, name)
+		if err == nil {
+			if name != hostname && !host.Wildcard {
+				return nil, shared.ErrNotFound
+			}
+			return host, nil
+		} else if err != shared.ErrNotFound {
+			return nil, err
+		}
+
+		dot := strings.Index(name, ".")
+		if dot < 0 {
+			return nil, err
+		}
+		name = name[dot+1:]
+	}
+}
+
+// List returns all records of the zone, which is used for zone transfers
+func (l *HostLookup) List(ctx context.Context, zone *shared.Zone) ([]*Response, error) {
+	responses, err := l.apexRecords(ctx, &Request{QName: zone.Name, QType: "ANY"}, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := ""
+	for {
+		hosts, next, err := l.hosts.ListHosts(ctx, zone.Name, cursor, 100)
+		if err != nil {
 			return nil, err
 		}
 
-		responseContent = host.Ip
+		for _, host := range hosts {
+			fqdn := zone.Fqdn(host.Hostname)
+
+			records, _ := l.hostRecords(&Request{QName: fqdn, QType: "ANY"}, host, false)
+			responses = append(responses, records...)
 
-		responseRecord = "A"
-		if !host.IsIPv4() {
-			responseRecord = "AAAA"
+			if host.Wildcard {
+				records, _ = l.hostRecords(&Request{QName: "*." + fqdn, QType: "ANY"}, host, false)
+				responses = append(responses, records...)
+			}
+
+			if len(host.TXT) > 0 {
+				records, _ = l.hostRecords(&Request{QName: acmeChallengeLabel + fqdn, QType: "ANY"}, host, true)
+				responses = append(responses, records...)
+			}
+
+			for _, service := range host.SRV.Services() {
+				records, _ = l.serviceRecords(&Request{QName: service + "." + fqdn, QType: "ANY"}, host, service)
+				responses = append(responses, records...)
+			}
 		}
 
-		if (request.QType == "A" || request.QType == "AAAA") && request.QType != responseRecord {
-			return nil, errors.New("IP address is not valid for requested record")
+		if next == "" {
+			return responses, nil
 		}
+		cursor = next
+	}
+}
+
+// hostRecords returns the records of the host that match the requested type.
+// When challenge is set, the request is for the ACME challenge of the host.
+func (l *HostLookup) hostRecords(request *Request, host *shared.Host, challenge bool) ([]*Response, error) {
+	responses := []*Response{}
+	ttl := l.config.TTL(host.TTL)
 
-	default:
-		return nil, errors.New("Invalid request")
+	if challenge {
+		if len(host.TXT) == 0 {
+			return nil, errors.New("No ACME challenge present for host")
+		}
+
+		// challenges are short-lived, so that they should not be cached
+		if request.QType == "TXT" || request.QType == "ANY" {
+			for _, value := range host.TXT {
+				responses = append(responses, l.buildResponse(request, "TXT", fmt.Sprintf("%q", value), l.config.MinTTL))
+			}
+		}
+
+		return responses, nil
+	}
+
+	// a CNAME is the only record of its name and answers queries of every
+	// type, so that resolvers chase its target
+	if host.CNAME != "" {
+		return append(responses, l.buildResponse(request, "CNAME", host.CNAME, ttl)), nil
+	}
+
+	if request.QType == "A" || request.QType == "ANY" {
+		for _, address := range host.IPv4 {
+			responses = append(responses, l.buildResponse(request, "A", address, ttl))
+		}
 	}
 
-	return &Response{QType: responseRecord, QName: request.QName, Content: responseContent, TTL: 5}, nil
+	if request.QType == "AAAA" || request.QType == "ANY" {
+		for _, address := range host.IPv6 {
+			responses = append(responses, l.buildResponse(request, "AAAA", address, ttl))
+		}
+	}
+
+	if request.QType == "MX" || request.QType == "ANY" {
+		for _, mx := range host.MX {
+			content := fmt.Sprintf("%d %s", mx.Priority, mx.Target)
+			responses = append(responses, l.buildResponse(request, "MX", content, ttl))
+		}
+	}
+
+	return responses, nil
 }
 
-// extractHostname extract the host part of the fqdn: pi.d.example.org -> pi
-func (l *HostLookup) extractHostname(rawQueryName string) (string, error) {
-	queryName := strings.ToLower(rawQueryName)
+// serviceRecords returns the SRV records of the service of the host, where a
+// service without records does not exist
+func (l *HostLookup) serviceRecords(request *Request, host *shared.Host, service string) ([]*Response, error) {
+	responses := []*Response{}
+	ttl := l.config.TTL(host.TTL)
+	found := false
+
+	for _, srv := range host.SRV {
+		if srv.Service != service {
+			continue
+		}
+		found = true
+
+		if request.QType == "SRV" || request.QType == "ANY" {
+			content := fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target)
+			responses = append(responses, l.buildResponse(request, "SRV", content, ttl))
+		}
+	}
 
-	hostname := ""
-	if strings.HasSuffix(queryName, l.config.Domain) {
-		hostname = queryName[:len(queryName)-len(l.config.Domain)]
+	if !found {
+		return nil, errors.New("No SRV records present for service")
 	}
 
-	if hostname == "" {
-		return "", errors.New("Query name does not correspond to our domain")
+	return responses, nil
+}
+
+func (l *HostLookup) buildResponse(request *Request, qtype, content string, ttl int) *Response {
+	return &Response{QType: qtype, QName: request.QName, Content: content, TTL: ttl}
+}
+
+// splitService splits the `_service._proto` labels of SRV records off the
+// hostname: _sip._udp.pi -> _sip._udp, pi
+func splitService(hostname string) (string, string) {
+	labels := strings.SplitN(hostname, ".", 3)
+	if len(labels) == 3 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") {
+		return strings.ToLower(labels[0] + "." + labels[1]), labels[2]
 	}
 
-	return hostname, nil
+	return "", hostname
 }
 
-// currentSOASerial get the current SOA serial by returning the current time in seconds
-func (l *HostLookup) currentSOASerial() int64 {
-	return time.Now().Unix()
+// splitProto splits the `_proto` label of the parent of SRV records off the
+// hostname: _udp.pi -> _udp, pi
+func splitProto(hostname string) (string, string) {
+	labels := strings.SplitN(hostname, ".", 2)
+	if len(labels) == 2 && strings.HasPrefix(labels[0], "_") {
+		return strings.ToLower(labels[0]), labels[1]
+	}
+
+	return "", hostname
 }
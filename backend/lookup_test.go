@@ -1,56 +1,229 @@
 package backend
 
 import (
-	"errors"
+	"context"
 	"github.com/pboehm/ddns/shared"
 	"github.com/stretchr/testify/assert"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 )
 
 type testHostBackend struct {
 	hosts map[string]*shared.Host
+
+	// unavailable simulates a storage outage
+	unavailable bool
+}
+
+func newTestHostBackend(hosts ...*shared.Host) *testHostBackend {
+	backend := &testHostBackend{hosts: map[string]*shared.Host{}}
+	for _, host := range hosts {
+		backend.CreateHost(context.Background(), host)
+	}
+	return backend
 }
 
-func (b *testHostBackend) GetHost(hostname string) (*shared.Host, error) {
-	host, ok := b.hosts[hostname]
+func (b *testHostBackend) GetHost(ctx context.Context, zone, hostname string) (*shared.Host, error) {
+	if b.unavailable {
+		return nil, shared.ErrUnavailable
+	}
+
+	host, ok := b.hosts[zone+"/"+hostname]
 	if ok {
 		return host, nil
 	} else {
-		return nil, errors.New("Host not found")
+		return nil, shared.ErrNotFound
 	}
 }
 
-func (b *testHostBackend) SetHost(host *shared.Host) error {
-	b.hosts[host.Hostname] = host
+func (b *testHostBackend) CreateHost(ctx context.Context, host *shared.Host) error {
+	if _, ok := b.hosts[host.Zone+"/"+host.Hostname]; ok {
+		return shared.ErrHostExists
+	}
+
+	b.hosts[host.Zone+"/"+host.Hostname] = host
+	return nil
+}
+
+func (b *testHostBackend) SetHost(ctx context.Context, host *shared.Host) error {
+	if _, ok := b.hosts[host.Zone+"/"+host.Hostname]; !ok {
+		return shared.ErrNotFound
+	}
+
+	b.hosts[host.Zone+"/"+host.Hostname] = host
 	return nil
 }
 
+func (b *testHostBackend) UpdateHost(ctx context.Context, zone, hostname string, update func(*shared.Host) error) error {
+	host, ok := b.hosts[zone+"/"+hostname]
+	if !ok {
+		return shared.ErrNotFound
+	}
+
+	return update(host)
+}
+
+func (b *testHostBackend) DeleteHost(ctx context.Context, zone, hostname string) error {
+	if _, ok := b.hosts[zone+"/"+hostname]; !ok {
+		return shared.ErrNotFound
+	}
+
+	delete(b.hosts, zone+"/"+hostname)
+	return nil
+}
+
+func (b *testHostBackend) ListHosts(ctx context.Context, zone, cursor string, count int) ([]*shared.Host, string, error) {
+	if b.unavailable {
+		return nil, "", shared.ErrUnavailable
+	}
+
+	keys := []string{}
+	for key := range b.hosts {
+		if strings.HasPrefix(key, zone+"/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(cursor)
+	end := start + count
+	next := strconv.Itoa(end)
+	if end >= len(keys) {
+		end, next = len(keys), ""
+	}
+
+	hosts := []*shared.Host{}
+	for _, key := range keys[start:end] {
+		hosts = append(hosts, b.hosts[key])
+	}
+
+	return hosts, next, nil
+}
+
+func (b *testHostBackend) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	if b.unavailable {
+		return 0, shared.ErrUnavailable
+	}
+
+	return 2020010100, nil
+}
+
 func buildLookup(domain string) (*shared.Config, *testHostBackend, *HostLookup) {
+	zone := strings.TrimPrefix(domain, ".")
+
 	config := &shared.Config{
-		Verbose: false,
-		Domain:  domain,
-		SOAFqdn: "dns" + domain,
+		Verbose:    false,
+		SOARefresh: 1800,
+		SOARetry:   3600,
+		SOAExpire:  7200,
+		SOAMinimum: 5,
+		DefaultTTL: 5,
+		MinTTL:     5,
+		MaxTTL:     86400,
+		Zones: []*shared.Zone{
+			{Name: zone, SOAFqdn: "dns." + zone, Hostmaster: "hostmaster." + zone, Nameservers: []string{"dns." + zone}},
+			{
+				Name:        "iot." + zone,
+				SOAFqdn:     "ns.iot." + zone,
+				Hostmaster:  "admin.example.net",
+				Nameservers: []string{"ns.iot." + zone, "ns2.example.net"},
+				ApexIPv4:    shared.Addresses{"10.20.30.1"},
+				ApexIPv6:    shared.Addresses{"2001:db8::53"},
+			},
+		},
 	}
 
-	hosts := &testHostBackend{
-		hosts: map[string]*shared.Host{
-			"www": {
-				Hostname: "www",
-				Ip:       "10.11.12.13",
-				Token:    "abcdef",
-			},
-			"v4": {
-				Hostname: "v4",
-				Ip:       "10.10.10.10",
-				Token:    "ghijkl",
+	hosts := newTestHostBackend(
+		&shared.Host{
+			Zone:     zone,
+			Hostname: "www",
+			IPv4:     shared.Addresses{"10.11.12.13"},
+			Tokens:   shared.HostTokens{"default": "abcdef"},
+		},
+		&shared.Host{
+			Zone:     zone,
+			Hostname: "v4",
+			IPv4:     shared.Addresses{"10.10.10.10"},
+			Tokens:   shared.HostTokens{"default": "ghijkl"},
+		},
+		&shared.Host{
+			Zone:     zone,
+			Hostname: "v6",
+			IPv6:     shared.Addresses{"2001:db8:85a3::8a2e:370:7334"},
+			Tokens:   shared.HostTokens{"default": "ghijkl"},
+		},
+		&shared.Host{
+			Zone:     zone,
+			Hostname: "dual",
+			IPv4:     shared.Addresses{"10.10.10.11"},
+			IPv6:     shared.Addresses{"2001:db8:85a3::8a2e:370:7335"},
+			Tokens:   shared.HostTokens{"default": "mnopqr"},
+		},
+		&shared.Host{
+			Zone:     zone,
+			Hostname: "acme",
+			IPv4:     shared.Addresses{"10.10.10.12"},
+			Tokens:   shared.HostTokens{"default": "stuvwx"},
+			TXT:      shared.TXTRecords{"first-challenge", "second-challenge"},
+		},
+		&shared.Host{
+			Zone:     zone,
+			Hostname: "ttl",
+			IPv4:     shared.Addresses{"10.10.10.13"},
+			Tokens:   shared.HostTokens{"default": "efghij"},
+			TTL:      3600,
+		},
+		&shared.Host{
+			Zone:     zone,
+			Hostname: "bigttl",
+			IPv6:     shared.Addresses{"2001:db8:85a3::8a2e:370:7336"},
+			Tokens:   shared.HostTokens{"default": "klmnop"},
+			TTL:      100000,
+		},
+		&shared.Host{
+			Zone:     zone,
+			Hostname: "alias",
+			CNAME:    "lb.cloud.example.net",
+			Tokens:   shared.HostTokens{"default": "qrstuv"},
+		},
+		&shared.Host{
+			Zone:     zone,
+			Hostname: "mail",
+			IPv4:     shared.Addresses{"10.10.10.14"},
+			Tokens:   shared.HostTokens{"default": "wxyzab"},
+			MX: shared.MXRecords{
+				{Priority: 10, Target: "mail." + zone},
+				{Priority: 20, Target: "backup.example.net"},
 			},
-			"v6": {
-				Hostname: "v6",
-				Ip:       "2001:db8:85a3::8a2e:370:7334",
-				Token:    "ghijkl",
+			SRV: shared.SRVRecords{
+				{Service: "_sip._udp", Priority: 10, Weight: 5, Port: 5060, Target: "mail." + zone},
+				{Service: "_minecraft._tcp", Priority: 0, Weight: 0, Port: 25565, Target: "mail." + zone},
 			},
 		},
-	}
+		&shared.Host{
+			Zone:     zone,
+			Hostname: "proxy",
+			IPv4:     shared.Addresses{"10.10.10.15"},
+			IPv6:     shared.Addresses{"2001:db8:85a3::8a2e:370:7337"},
+			Tokens:   shared.HostTokens{"default": "cdefgh"},
+			Wildcard: true,
+		},
+		&shared.Host{
+			Zone:     zone,
+			Hostname: "rr",
+			IPv4:     shared.Addresses{"10.10.10.17", "10.10.10.18"},
+			IPv6:     shared.Addresses{"2001:db8:85a3::8a2e:370:7338", "2001:db8:85a3::8a2e:370:7339"},
+			Tokens:   shared.HostTokens{"default": "ijklmn"},
+		},
+		&shared.Host{
+			Zone:     "iot." + zone,
+			Hostname: "www",
+			IPv4:     shared.Addresses{"10.20.30.40"},
+			Tokens:   shared.HostTokens{"default": "yzabcd"},
+		},
+	)
 
 	return config, hosts, &HostLookup{config, hosts}
 }
@@ -62,92 +235,432 @@ func buildRequest(queryName, queryType string) *Request {
 	}
 }
 
+func lookupSingle(t *testing.T, lookup *HostLookup, queryName, queryType string) *Response {
+	responses, err := lookup.Lookup(context.Background(), buildRequest(queryName, queryType))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 1)
+
+	if len(responses) == 0 {
+		return &Response{}
+	}
+	return responses[0]
+}
+
 func TestRequestHandling(t *testing.T) {
 	_, _, lookup := buildLookup(".example.org")
 
-	response, err := lookup.Lookup(buildRequest("example.org", "SOA"))
-	assert.Nil(t, err)
-	assert.NotNil(t, response)
+	response := lookupSingle(t, lookup, "example.org", "SOA")
 	assert.Equal(t, "SOA", response.QType)
 	assert.Equal(t, "example.org", response.QName)
-	assert.Regexp(t, "dns\\.example\\.org\\. hostmaster\\.example.org\\. \\d+ 1800 3600 7200 5", response.Content)
+	assert.Equal(t, "dns.example.org. hostmaster.example.org. 2020010100 1800 3600 7200 5", response.Content)
 	assert.Equal(t, 5, response.TTL)
 
-	response, err = lookup.Lookup(buildRequest("example.org", "NS"))
-	assert.Nil(t, err)
-	assert.NotNil(t, response)
+	response = lookupSingle(t, lookup, "example.org", "NS")
 	assert.Equal(t, "NS", response.QType)
 	assert.Equal(t, "example.org", response.QName)
 	assert.Equal(t, "dns.example.org", response.Content)
 	assert.Equal(t, 5, response.TTL)
 
-	response, err = lookup.Lookup(buildRequest("www.example.org", "ANY"))
-	assert.Nil(t, err)
-	assert.NotNil(t, response)
+	response = lookupSingle(t, lookup, "www.example.org", "ANY")
 	assert.Equal(t, "A", response.QType)
 	assert.Equal(t, "www.example.org", response.QName)
 	assert.Equal(t, "10.11.12.13", response.Content)
 	assert.Equal(t, 5, response.TTL)
 
-	response, err = lookup.Lookup(buildRequest("www.example.org", "A"))
-	assert.Nil(t, err)
-	assert.NotNil(t, response)
+	response = lookupSingle(t, lookup, "www.example.org", "A")
 	assert.Equal(t, "A", response.QType)
 	assert.Equal(t, "www.example.org", response.QName)
 	assert.Equal(t, "10.11.12.13", response.Content)
 	assert.Equal(t, 5, response.TTL)
 
 	// Allow hostname to be mixed case which is used by Let's Encrypt for a little bit more security
-	response, err = lookup.Lookup(buildRequest("wWW.eXaMPlE.oRg", "A"))
-	assert.Nil(t, err)
-	assert.NotNil(t, response)
+	response = lookupSingle(t, lookup, "wWW.eXaMPlE.oRg", "A")
 	assert.Equal(t, "A", response.QType)
 	assert.Equal(t, "wWW.eXaMPlE.oRg", response.QName)
 	assert.Equal(t, "10.11.12.13", response.Content)
 	assert.Equal(t, 5, response.TTL)
 
-	response, err = lookup.Lookup(buildRequest("notexisting.example.org", "A"))
+	responses, err := lookup.Lookup(context.Background(), buildRequest("notexisting.example.org", "A"))
 	assert.NotNil(t, err)
-	assert.Nil(t, response)
+	assert.Nil(t, responses)
 
 	// Correct Handling of IPv4/IPv6 and ANY/A/AAAA
-	response, err = lookup.Lookup(buildRequest("v4.example.org", "ANY"))
-	assert.Nil(t, err)
-	assert.NotNil(t, response)
+	response = lookupSingle(t, lookup, "v4.example.org", "ANY")
 	assert.Equal(t, "A", response.QType)
 	assert.Equal(t, "v4.example.org", response.QName)
 	assert.Equal(t, "10.10.10.10", response.Content)
 	assert.Equal(t, 5, response.TTL)
 
-	response, err = lookup.Lookup(buildRequest("v4.example.org", "A"))
-	assert.Nil(t, err)
-	assert.NotNil(t, response)
+	response = lookupSingle(t, lookup, "v4.example.org", "A")
 	assert.Equal(t, "A", response.QType)
 	assert.Equal(t, "v4.example.org", response.QName)
 	assert.Equal(t, "10.10.10.10", response.Content)
 	assert.Equal(t, 5, response.TTL)
 
-	response, err = lookup.Lookup(buildRequest("v4.example.org", "AAAA"))
-	assert.NotNil(t, err)
-	assert.Nil(t, response)
-
-	response, err = lookup.Lookup(buildRequest("v6.example.org", "ANY"))
+	// Existing hosts without an address of the requested family have no records
+	responses, err = lookup.Lookup(context.Background(), buildRequest("v4.example.org", "AAAA"))
 	assert.Nil(t, err)
-	assert.NotNil(t, response)
+	assert.Empty(t, responses)
+
+	response = lookupSingle(t, lookup, "v6.example.org", "ANY")
 	assert.Equal(t, "AAAA", response.QType)
 	assert.Equal(t, "v6.example.org", response.QName)
 	assert.Equal(t, "2001:db8:85a3::8a2e:370:7334", response.Content)
 	assert.Equal(t, 5, response.TTL)
 
-	response, err = lookup.Lookup(buildRequest("v6.example.org", "AAAA"))
-	assert.Nil(t, err)
-	assert.NotNil(t, response)
+	response = lookupSingle(t, lookup, "v6.example.org", "AAAA")
 	assert.Equal(t, "AAAA", response.QType)
 	assert.Equal(t, "v6.example.org", response.QName)
 	assert.Equal(t, "2001:db8:85a3::8a2e:370:7334", response.Content)
 	assert.Equal(t, 5, response.TTL)
 
-	response, err = lookup.Lookup(buildRequest("v6.example.org", "A"))
+	responses, err = lookup.Lookup(context.Background(), buildRequest("v6.example.org", "A"))
+	assert.Nil(t, err)
+	assert.Empty(t, responses)
+}
+
+func TestDualStackHandling(t *testing.T) {
+	_, _, lookup := buildLookup(".example.org")
+
+	response := lookupSingle(t, lookup, "dual.example.org", "A")
+	assert.Equal(t, "A", response.QType)
+	assert.Equal(t, "10.10.10.11", response.Content)
+
+	response = lookupSingle(t, lookup, "dual.example.org", "AAAA")
+	assert.Equal(t, "AAAA", response.QType)
+	assert.Equal(t, "2001:db8:85a3::8a2e:370:7335", response.Content)
+
+	responses, err := lookup.Lookup(context.Background(), buildRequest("dual.example.org", "ANY"))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 2)
+	assert.Equal(t, "A", responses[0].QType)
+	assert.Equal(t, "10.10.10.11", responses[0].Content)
+	assert.Equal(t, "AAAA", responses[1].QType)
+	assert.Equal(t, "2001:db8:85a3::8a2e:370:7335", responses[1].Content)
+}
+
+func TestMultipleAddressHandling(t *testing.T) {
+	_, _, lookup := buildLookup(".example.org")
+
+	responses, err := lookup.Lookup(context.Background(), buildRequest("rr.example.org", "A"))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 2)
+	assert.Equal(t, "10.10.10.17", responses[0].Content)
+	assert.Equal(t, "10.10.10.18", responses[1].Content)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("rr.example.org", "AAAA"))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 2)
+	assert.Equal(t, "AAAA", responses[1].QType)
+	assert.Equal(t, "2001:db8:85a3::8a2e:370:7339", responses[1].Content)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("rr.example.org", "ANY"))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 4)
+}
+
+func TestAcmeChallengeHandling(t *testing.T) {
+	_, _, lookup := buildLookup(".example.org")
+
+	responses, err := lookup.Lookup(context.Background(), buildRequest("_acme-challenge.acme.example.org", "TXT"))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 2)
+	assert.Equal(t, "TXT", responses[0].QType)
+	assert.Equal(t, "_acme-challenge.acme.example.org", responses[0].QName)
+	assert.Equal(t, "\"first-challenge\"", responses[0].Content)
+	assert.Equal(t, "\"second-challenge\"", responses[1].Content)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("_acme-challenge.acme.example.org", "ANY"))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 2)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("_acme-challenge.acme.example.org", "A"))
+	assert.Nil(t, err)
+	assert.Empty(t, responses)
+
+	// the host itself has no TXT records
+	responses, err = lookup.Lookup(context.Background(), buildRequest("acme.example.org", "TXT"))
+	assert.Nil(t, err)
+	assert.Empty(t, responses)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("_acme-challenge.www.example.org", "TXT"))
+	assert.NotNil(t, err)
+	assert.Nil(t, responses)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("_acme-challenge.notexisting.example.org", "TXT"))
 	assert.NotNil(t, err)
-	assert.Nil(t, response)
+	assert.Nil(t, responses)
+}
+
+func TestListHandling(t *testing.T) {
+	_, _, lookup := buildLookup(".example.org")
+
+	responses, err := lookup.List(context.Background(), lookup.config.Zones[0])
+	assert.Nil(t, err)
+
+	records := []string{}
+	for _, response := range responses {
+		records = append(records, response.QName+" "+response.QType)
+	}
+
+	assert.Equal(t, []string{
+		"example.org SOA",
+		"example.org NS",
+		"acme.example.org A",
+		"_acme-challenge.acme.example.org TXT",
+		"_acme-challenge.acme.example.org TXT",
+		"alias.example.org CNAME",
+		"bigttl.example.org AAAA",
+		"dual.example.org A",
+		"dual.example.org AAAA",
+		"mail.example.org A",
+		"mail.example.org MX",
+		"mail.example.org MX",
+		"_sip._udp.mail.example.org SRV",
+		"_minecraft._tcp.mail.example.org SRV",
+		"proxy.example.org A",
+		"proxy.example.org AAAA",
+		"*.proxy.example.org A",
+		"*.proxy.example.org AAAA",
+		"rr.example.org A",
+		"rr.example.org A",
+		"rr.example.org AAAA",
+		"rr.example.org AAAA",
+		"ttl.example.org A",
+		"v4.example.org A",
+		"v6.example.org AAAA",
+		"www.example.org A",
+	}, records)
+}
+
+func TestCNAMEHandling(t *testing.T) {
+	_, _, lookup := buildLookup(".example.org")
+
+	// the CNAME is returned for every type, so that resolvers chase the target
+	for _, qtype := range []string{"CNAME", "A", "AAAA", "TXT", "ANY"} {
+		response := lookupSingle(t, lookup, "alias.example.org", qtype)
+		assert.Equal(t, "CNAME", response.QType)
+		assert.Equal(t, "alias.example.org", response.QName)
+		assert.Equal(t, "lb.cloud.example.net", response.Content)
+		assert.Equal(t, 5, response.TTL)
+	}
+
+	responses, err := lookup.Lookup(context.Background(), buildRequest("www.example.org", "CNAME"))
+	assert.Nil(t, err)
+	assert.Empty(t, responses)
+}
+
+func TestMXAndSRVHandling(t *testing.T) {
+	_, _, lookup := buildLookup(".example.org")
+
+	responses, err := lookup.Lookup(context.Background(), buildRequest("mail.example.org", "MX"))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 2)
+	assert.Equal(t, "MX", responses[0].QType)
+	assert.Equal(t, "10 mail.example.org", responses[0].Content)
+	assert.Equal(t, "20 backup.example.net", responses[1].Content)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("mail.example.org", "ANY"))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 3)
+
+	response := lookupSingle(t, lookup, "_sip._udp.mail.example.org", "SRV")
+	assert.Equal(t, "SRV", response.QType)
+	assert.Equal(t, "_sip._udp.mail.example.org", response.QName)
+	assert.Equal(t, "10 5 5060 mail.example.org", response.Content)
+
+	response = lookupSingle(t, lookup, "_minecraft._tcp.mail.example.org", "ANY")
+	assert.Equal(t, "0 0 25565 mail.example.org", response.Content)
+
+	// the name of a service exists, but has only SRV records
+	responses, err = lookup.Lookup(context.Background(), buildRequest("_sip._udp.mail.example.org", "A"))
+	assert.Nil(t, err)
+	assert.Empty(t, responses)
+
+	// the protocol label of a service exists, but has no records
+	for _, qtype := range []string{"SRV", "A", "ANY"} {
+		responses, err = lookup.Lookup(context.Background(), buildRequest("_udp.mail.example.org", qtype))
+		assert.Nil(t, err)
+		assert.NotNil(t, responses)
+		assert.Empty(t, responses)
+	}
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("_udp.www.example.org", "SRV"))
+	assert.Equal(t, shared.ErrNotFound, err)
+	assert.Nil(t, responses)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("_xmpp.mail.example.org", "A"))
+	assert.Equal(t, shared.ErrNotFound, err)
+	assert.Nil(t, responses)
+
+	// services without records and hosts without MX records
+	responses, err = lookup.Lookup(context.Background(), buildRequest("_xmpp._tcp.mail.example.org", "SRV"))
+	assert.NotNil(t, err)
+	assert.Nil(t, responses)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("www.example.org", "MX"))
+	assert.Nil(t, err)
+	assert.Empty(t, responses)
+}
+
+func TestWildcardHandling(t *testing.T) {
+	_, hosts, lookup := buildLookup(".example.org")
+
+	// names below a host with the wildcard flag resolve to its addresses
+	for _, name := range []string{"proxy.example.org", "app.proxy.example.org", "deeply.nested.app.proxy.example.org"} {
+		response := lookupSingle(t, lookup, name, "A")
+		assert.Equal(t, "A", response.QType)
+		assert.Equal(t, name, response.QName)
+		assert.Equal(t, "10.10.10.15", response.Content)
+
+		response = lookupSingle(t, lookup, name, "AAAA")
+		assert.Equal(t, "2001:db8:85a3::8a2e:370:7337", response.Content)
+	}
+
+	responses, err := lookup.Lookup(context.Background(), buildRequest("App.Proxy.example.org", "ANY"))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 2)
+
+	// hosts without the flag have no names below them
+	for _, name := range []string{"app.www.example.org", "nested.app.www.example.org", "app.notexisting.example.org"} {
+		responses, err = lookup.Lookup(context.Background(), buildRequest(name, "A"))
+		assert.Equal(t, shared.ErrNotFound, err)
+		assert.Nil(t, responses)
+	}
+
+	// a registered host below a wildcard host answers on its own, as does
+	// the closest host, which hides the wildcard host above it
+	hosts.CreateHost(context.Background(), &shared.Host{Zone: "example.org", Hostname: "app.proxy", IPv4: shared.Addresses{"10.10.10.16"}})
+
+	response := lookupSingle(t, lookup, "app.proxy.example.org", "A")
+	assert.Equal(t, "10.10.10.16", response.Content)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("nested.app.proxy.example.org", "A"))
+	assert.Equal(t, shared.ErrNotFound, err)
+	assert.Nil(t, responses)
+
+	// ACME challenges and SRV records are not covered by the wildcard
+	responses, err = lookup.Lookup(context.Background(), buildRequest("_acme-challenge.other.proxy.example.org", "TXT"))
+	assert.NotNil(t, err)
+	assert.Nil(t, responses)
+
+	// an unavailable storage is not mistaken for a missing host
+	hosts.unavailable = true
+	_, err = lookup.Lookup(context.Background(), buildRequest("other.proxy.example.org", "A"))
+	assert.Equal(t, shared.ErrUnavailable, err)
+}
+
+func TestApexHandling(t *testing.T) {
+	_, _, lookup := buildLookup(".example.org")
+
+	// the apex has only the configured addresses
+	responses, err := lookup.Lookup(context.Background(), buildRequest("example.org", "A"))
+	assert.Nil(t, err)
+	assert.Empty(t, responses)
+
+	response := lookupSingle(t, lookup, "iot.example.org", "A")
+	assert.Equal(t, "iot.example.org", response.QName)
+	assert.Equal(t, "10.20.30.1", response.Content)
+
+	response = lookupSingle(t, lookup, "iot.example.org", "AAAA")
+	assert.Equal(t, "2001:db8::53", response.Content)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("iot.example.org", "ANY"))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 5)
+
+	// NS and SOA records only exist at the apex
+	for _, qtype := range []string{"NS", "SOA"} {
+		responses, err = lookup.Lookup(context.Background(), buildRequest("www.example.org", qtype))
+		assert.Nil(t, err)
+		assert.Empty(t, responses)
+	}
+
+	// types we do not serve result in no records for existing names only
+	for _, name := range []string{"example.org", "www.example.org", "_acme-challenge.acme.example.org"} {
+		responses, err = lookup.Lookup(context.Background(), buildRequest(name, "HINFO"))
+		assert.Nil(t, err, name)
+		assert.Empty(t, responses)
+	}
+
+	_, err = lookup.Lookup(context.Background(), buildRequest("notexisting.example.org", "HINFO"))
+	assert.Equal(t, shared.ErrNotFound, err)
+}
+
+func TestMultipleZoneHandling(t *testing.T) {
+	_, _, lookup := buildLookup(".example.org")
+
+	// the most specific zone is used for a query
+	response := lookupSingle(t, lookup, "www.iot.example.org", "A")
+	assert.Equal(t, "www.iot.example.org", response.QName)
+	assert.Equal(t, "10.20.30.40", response.Content)
+
+	response = lookupSingle(t, lookup, "www.example.org", "A")
+	assert.Equal(t, "10.11.12.13", response.Content)
+
+	response = lookupSingle(t, lookup, "iot.example.org", "SOA")
+	assert.Regexp(t, "^ns\\.iot\\.example\\.org\\. admin\\.example\\.net\\. \\d+ ", response.Content)
+
+	responses, err := lookup.Lookup(context.Background(), buildRequest("iot.example.org", "NS"))
+	assert.Nil(t, err)
+	assert.Len(t, responses, 2)
+	assert.Equal(t, "ns.iot.example.org", responses[0].Content)
+	assert.Equal(t, "ns2.example.net", responses[1].Content)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("dual.iot.example.org", "A"))
+	assert.NotNil(t, err)
+	assert.Nil(t, responses)
+
+	responses, err = lookup.Lookup(context.Background(), buildRequest("www.example.net", "A"))
+	assert.NotNil(t, err)
+	assert.Nil(t, responses)
+
+	responses, err = lookup.List(context.Background(), lookup.config.Zones[1])
+	assert.Nil(t, err)
+	assert.Len(t, responses, 6)
+	assert.Equal(t, "A", responses[3].QType)
+	assert.Equal(t, "www.iot.example.org", responses[5].QName)
+}
+
+func TestTTLHandling(t *testing.T) {
+	_, _, lookup := buildLookup(".example.org")
+
+	response := lookupSingle(t, lookup, "ttl.example.org", "A")
+	assert.Equal(t, 3600, response.TTL)
+
+	response = lookupSingle(t, lookup, "ttl.example.org", "ANY")
+	assert.Equal(t, 3600, response.TTL)
+
+	// custom TTLs are bounded by the configured maximum
+	response = lookupSingle(t, lookup, "bigttl.example.org", "AAAA")
+	assert.Equal(t, 86400, response.TTL)
+
+	lookup.config.DefaultTTL = 300
+	lookup.config.SOAMinimum = 300
+
+	response = lookupSingle(t, lookup, "www.example.org", "A")
+	assert.Equal(t, 300, response.TTL)
+
+	response = lookupSingle(t, lookup, "example.org", "SOA")
+	assert.Equal(t, 300, response.TTL)
+	assert.Regexp(t, " 300$", response.Content)
+}
+
+func TestUnavailableBackendHandling(t *testing.T) {
+	_, hosts, lookup := buildLookup(".example.org")
+	hosts.unavailable = true
+
+	for _, qtype := range []string{"A", "SOA"} {
+		responses, err := lookup.Lookup(context.Background(), buildRequest("www.example.org", qtype))
+		assert.Equal(t, shared.ErrUnavailable, err)
+		assert.Nil(t, responses)
+	}
+
+	_, err := lookup.List(context.Background(), lookup.config.Zones[0])
+	assert.Equal(t, shared.ErrUnavailable, err)
+
+	// unknown hosts are reported as such while the storage is available
+	hosts.unavailable = false
+	_, err = lookup.Lookup(context.Background(), buildRequest("notexisting.example.org", "A"))
+	assert.Equal(t, shared.ErrNotFound, err)
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/pboehm/ddns/shared"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// migrateRedisKeys moves hosts stored by previous versions to prefixed keys
+func migrateRedisKeys() {
+	if serviceConfig.StorageType != "redis" {
+		log.Fatal("The keys can only be migrated when Redis is used as storage")
+	}
+
+	redis := shared.NewRedisBackend(serviceConfig)
+	defer redis.Close()
+
+	migrated, err := redis.MigrateKeys()
+	if err != nil {
+		log.Fatalf("Error while migrating the keys after %d hosts: %v", migrated, err)
+	}
+
+	log.Printf("Migrated %d hosts", migrated)
+}
+
+// hostsCommand manages the hosts from the command line:
+//
+//	ddns [FLAGS] hosts list [ZONE]
+func hostsCommand(args []string) {
+	if len(args) == 0 || args[0] != "list" || len(args) > 2 {
+		log.Fatal("Usage: ddns [FLAGS] hosts list [ZONE]")
+	}
+
+	zones := serviceConfig.Zones
+	if len(args) == 2 {
+		zone := serviceConfig.GetZone(args[1])
+		if zone == nil {
+			log.Fatalf("The zone %s does not exist", args[1])
+		}
+		zones = []*shared.Zone{zone}
+	}
+
+	storage, err := shared.OpenStorage(serviceConfig)
+	if err != nil {
+		log.Fatalf("Could not open the storage: %v", err)
+	}
+	defer storage.Close()
+
+	if err = listHosts(context.Background(), os.Stdout, storage, zones); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listHosts writes the hosts of the zones as a table
+func listHosts(ctx context.Context, w io.Writer, hosts shared.HostBackend, zones []*shared.Zone) error {
+	out := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "HOST\tIPV4\tIPV6\tCNAME\tUPDATED\tEXPIRES")
+
+	for _, zone := range zones {
+		cursor := ""
+		for {
+			page, next, err := hosts.ListHosts(ctx, zone.Name, cursor, 100)
+			if err != nil {
+				return fmt.Errorf("Could not list the hosts of %s: %v", zone.Name, err)
+			}
+
+			for _, host := range page {
+				fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\n", zone.Fqdn(host.Hostname),
+					orDash(host.IPv4.String()), orDash(host.IPv6.String()), orDash(host.CNAME), formatTime(host.UpdatedAt), formatTime(host.ExpiresAt))
+			}
+
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+
+	return out.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pboehm/ddns/shared"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func buildStorage(t *testing.T) (*shared.Config, shared.Storage, func()) {
+	dir, err := ioutil.TempDir("", "ddns-commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &shared.Config{
+		StorageType: "bolt",
+		BoltPath:    filepath.Join(dir, "ddns.db"),
+		Zones: []*shared.Zone{
+			{Name: "example.org", SOAFqdn: "ns.example.org", HostExpirationDays: 10},
+			{Name: "iot.example.org", SOAFqdn: "ns.example.org", HostExpirationDays: 10},
+		},
+	}
+
+	storage, err := shared.OpenStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return config, storage, func() {
+		storage.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestListHosts(t *testing.T) {
+	config, storage, cleanup := buildStorage(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	pi := &shared.Host{Zone: "example.org", Hostname: "pi", IPv4: shared.Addresses{"10.0.0.1", "10.0.0.2"}, IPv6: shared.Addresses{"2001:db8::1"}}
+	assert.Nil(t, storage.CreateHost(ctx, pi))
+	assert.Nil(t, storage.CreateHost(ctx, &shared.Host{Zone: "example.org", Hostname: "www", CNAME: "pi.example.org"}))
+	assert.Nil(t, storage.CreateHost(ctx, &shared.Host{Zone: "iot.example.org", Hostname: "sensor", IPv6: shared.Addresses{"2001:db8::2"}}))
+
+	var out bytes.Buffer
+	assert.Nil(t, listHosts(ctx, &out, storage, config.Zones))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(t, lines, 4) {
+		assert.Equal(t, []string{"HOST", "IPV4", "IPV6", "CNAME", "UPDATED", "EXPIRES"}, strings.Fields(lines[0]))
+
+		fields := strings.Fields(lines[1])
+		assert.Equal(t, []string{"pi.example.org", "10.0.0.1,10.0.0.2", "2001:db8::1", "-"}, fields[:4])
+		assert.Equal(t, formatTime(pi.UpdatedAt), strings.Join(fields[4:6], " "))
+		assert.Equal(t, formatTime(pi.ExpiresAt), strings.Join(fields[6:8], " "))
+
+		assert.Equal(t, []string{"www.example.org", "-", "-", "pi.example.org"}, strings.Fields(lines[2])[:4])
+		assert.Equal(t, []string{"sensor.iot.example.org", "-", "2001:db8::2", "-"}, strings.Fields(lines[3])[:4])
+	}
+
+	// only the hosts of the passed zones are listed
+	out.Reset()
+	assert.Nil(t, listHosts(ctx, &out, storage, config.Zones[1:]))
+	assert.Equal(t, 2, strings.Count(out.String(), "\n"))
+}
+
+func TestListHostsPages(t *testing.T) {
+	config, storage, cleanup := buildStorage(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// more hosts than fit on a single page
+	for i := 0; i < 250; i++ {
+		assert.Nil(t, storage.CreateHost(ctx, &shared.Host{Zone: "example.org", Hostname: fmt.Sprintf("host%03d", i)}))
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, listHosts(ctx, &out, storage, config.Zones))
+	assert.Equal(t, 251, strings.Count(out.String(), "\n"))
+	assert.Contains(t, out.String(), "host249.example.org")
+}
+
+// unavailableHosts fails to list the hosts like an unreachable storage
+type unavailableHosts struct {
+	shared.HostBackend
+}
+
+func (unavailableHosts) ListHosts(ctx context.Context, zone, cursor string, count int) ([]*shared.Host, string, error) {
+	return nil, "", shared.ErrUnavailable
+}
+
+func TestListHostsUnavailable(t *testing.T) {
+	config, storage, cleanup := buildStorage(t)
+	defer cleanup()
+
+	var out bytes.Buffer
+	err := listHosts(context.Background(), &out, unavailableHosts{storage}, config.Zones)
+	assert.EqualError(t, err, "Could not list the hosts of example.org: Host storage is unavailable")
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"github.com/pboehm/ddns/backend"
 	"github.com/pboehm/ddns/frontend"
 	"github.com/pboehm/ddns/shared"
@@ -17,21 +20,46 @@ func init() {
 func main() {
 	serviceConfig.Validate()
 
-	redis := shared.NewRedisBackend(serviceConfig)
-	defer redis.Close()
+	switch flag.Arg(0) {
+	case "":
+		if err := serve(); err != nil {
+			log.Fatal(err)
+		}
+	case "migrate-redis-keys":
+		migrateRedisKeys()
+	case "hosts":
+		hostsCommand(flag.Args()[1:])
+	default:
+		log.Fatalf("Unknown command %q, supported are: hosts, migrate-redis-keys", flag.Arg(0))
+	}
+}
+
+// serve runs the servers until one of them fails, which stops the others, so
+// that the storage is closed before the error is returned
+func serve() error {
+	storage, err := shared.OpenStorage(serviceConfig)
+	if err != nil {
+		return fmt.Errorf("Could not open the storage: %v", err)
+	}
+	defer storage.Close()
 
-	var group errgroup.Group
+	lookup := backend.NewHostLookup(serviceConfig, storage)
+
+	group, ctx := errgroup.WithContext(context.Background())
 
 	group.Go(func() error {
-		lookup := backend.NewHostLookup(serviceConfig, redis)
-		return backend.NewBackend(serviceConfig, lookup).Run()
+		return backend.NewBackend(serviceConfig, lookup).Run(ctx)
 	})
 
+	if serviceConfig.ListenDNS != "" {
+		group.Go(func() error {
+			return backend.NewDNSServer(serviceConfig, lookup).Run(ctx)
+		})
+	}
+
 	group.Go(func() error {
-		return frontend.NewFrontend(serviceConfig, redis).Run()
+		return frontend.NewFrontend(serviceConfig, storage).Run(ctx)
 	})
 
-	if err := group.Wait(); err != nil {
-		log.Fatal(err)
-	}
+	return group.Wait()
 }
@@ -0,0 +1,75 @@
+package frontend
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/pboehm/ddns/shared"
+	"strings"
+)
+
+const acmeChallengeLabel = "_acme-challenge."
+
+// acmeRequest is the body sent by the lego "httpreq" DNS provider
+type acmeRequest struct {
+	Fqdn  string `json:"fqdn" binding:"required"`
+	Value string `json:"value" binding:"required"`
+}
+
+// handleAcmePresent creates the TXT record for an ACME DNS-01 challenge
+func (f *Frontend) handleAcmePresent(c *gin.Context) {
+	f.handleAcmeRequest(c, func(host *shared.Host, value string) error {
+		return host.AddTXT(value)
+	})
+}
+
+// handleAcmeCleanup removes the TXT record of a finished ACME DNS-01 challenge
+func (f *Frontend) handleAcmeCleanup(c *gin.Context) {
+	f.handleAcmeRequest(c, func(host *shared.Host, value string) error {
+		host.RemoveTXT(value)
+		return nil
+	})
+}
+
+// handleAcmeRequest authenticates the request using the host token passed as
+// the password of the HTTP Basic authentication and applies the change to the
+// host the challenge belongs to
+func (f *Frontend) handleAcmeRequest(c *gin.Context, change func(*shared.Host, string) error) {
+	_, token, ok := c.Request.BasicAuth()
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="DDNS"`)
+		c.JSON(401, gin.H{"error": "You have to supply the token of the host"})
+		return
+	}
+
+	var request acmeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": "The request is not in the right format"})
+		return
+	}
+
+	fqdn := strings.TrimSuffix(strings.ToLower(request.Fqdn), ".")
+	if !strings.HasPrefix(fqdn, acmeChallengeLabel) {
+		c.JSON(400, gin.H{"error": "Only _acme-challenge records can be managed"})
+		return
+	}
+
+	zone, hostname, valid := f.hostnameFromFqdn(strings.TrimPrefix(fqdn, acmeChallengeLabel))
+	if !valid {
+		c.JSON(404, gin.H{"error": "This hostname is not valid"})
+		return
+	}
+
+	// the change is applied to the current host within the storage, so that
+	// the challenges for a host and its wildcard can be presented concurrently
+	host, err := f.updateHost(c.Request.Context(), zone.Name, hostname, token, func(host *shared.Host, _ string) error {
+		return change(host, request.Value)
+	})
+	if err != nil {
+		respondError(c, err, 400, "Could not update the TXT records")
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"hostname": host.Hostname,
+		"txt":      host.TXT,
+	})
+}
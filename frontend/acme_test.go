@@ -0,0 +1,132 @@
+package frontend
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pboehm/ddns/shared"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// serveAcme sends the challenge like the lego "httpreq" DNS provider and
+// returns the status code and the decoded response
+func serveAcme(t *testing.T, f *Frontend, action, fqdn, value string, headers map[string]string) (int, map[string]interface{}) {
+	body := fmt.Sprintf(`{"fqdn": %q, "value": %q}`, fqdn, value)
+	recorder := serve(f, "POST", "/acme/"+action, strings.NewReader(body), headers)
+
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%s %s: invalid JSON %q", action, fqdn, recorder.Body.String())
+	}
+	return recorder.Code, result
+}
+
+func TestAcmeChallenges(t *testing.T) {
+	f, hosts := buildFrontend(t)
+	auth := basicAuth("pi", "secret")
+
+	code, result := serveAcme(t, f, "present", "_acme-challenge.pi.example.org.", "first", auth)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "pi", result["hostname"])
+	assert.Equal(t, []interface{}{"first"}, result["txt"])
+
+	// the challenges for the host and its wildcard are present at the same time
+	code, result = serveAcme(t, f, "present", "_acme-challenge.PI.example.org", "second", auth)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []interface{}{"first", "second"}, result["txt"])
+
+	code, _ = serveAcme(t, f, "present", "_acme-challenge.pi.example.org", "second", auth)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, shared.TXTRecords{"first", "second"}, hosts.host(t, "pi").TXT)
+
+	code, result = serveAcme(t, f, "cleanup", "_acme-challenge.pi.example.org", "first", auth)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []interface{}{"second"}, result["txt"])
+	assert.Equal(t, shared.TXTRecords{"second"}, hosts.host(t, "pi").TXT)
+
+	// the addresses of the host are left alone
+	assert.Equal(t, shared.Addresses{"10.0.0.1"}, hosts.host(t, "pi").IPv4)
+}
+
+func TestAcmeTXTLimit(t *testing.T) {
+	f, hosts := buildFrontend(t)
+	auth := basicAuth("pi", "secret")
+
+	for i := 0; i < shared.MaxTXTRecords; i++ {
+		code, _ := serveAcme(t, f, "present", "_acme-challenge.pi.example.org", fmt.Sprintf("value%d", i), auth)
+		assert.Equal(t, 200, code)
+	}
+
+	code, result := serveAcme(t, f, "present", "_acme-challenge.pi.example.org", "onemore", auth)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "Too many TXT values", result["error"])
+
+	code, _ = serveAcme(t, f, "present", "_acme-challenge.pi.example.org", "invalid value", auth)
+	assert.Equal(t, 400, code)
+
+	assert.Len(t, hosts.host(t, "pi").TXT, shared.MaxTXTRecords)
+}
+
+func TestAcmeErrors(t *testing.T) {
+	f, hosts := buildFrontend(t)
+	auth := basicAuth("pi", "secret")
+
+	recorder := serve(f, "POST", "/acme/present", strings.NewReader(`{"fqdn": "_acme-challenge.pi.example.org", "value": "abc"}`), nil)
+	assert.Equal(t, 401, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get("WWW-Authenticate"))
+
+	code, _ := serveAcme(t, f, "present", "_acme-challenge.pi.example.org", "abc", basicAuth("pi", "wrong"))
+	assert.Equal(t, 403, code)
+
+	// only the challenges of hosts in our zones can be managed
+	for _, fqdn := range []string{"pi.example.org", "_acme-challengepi.example.org", "www._acme-challenge.pi.example.org"} {
+		code, _ = serveAcme(t, f, "present", fqdn, "abc", auth)
+		assert.Equal(t, 400, code, fqdn)
+	}
+
+	code, _ = serveAcme(t, f, "present", "_acme-challenge.pi.example.net", "abc", auth)
+	assert.Equal(t, 404, code)
+
+	code, _ = serveAcme(t, f, "cleanup", "_acme-challenge.notexisting.example.org", "abc", auth)
+	assert.Equal(t, 404, code)
+
+	recorder = serve(f, "POST", "/acme/present", strings.NewReader(`{"fqdn": "_acme-challenge.pi.example.org"}`), auth)
+	assert.Equal(t, 400, recorder.Code)
+
+	assert.Empty(t, hosts.host(t, "pi").TXT)
+
+	hosts.unavailable = true
+	code, _ = serveAcme(t, f, "present", "_acme-challenge.pi.example.org", "abc", auth)
+	assert.Equal(t, 503, code)
+}
+
+func TestAcmeConcurrentUpdate(t *testing.T) {
+	f, hosts := buildFrontend(t)
+	auth := basicAuth("pi", "secret")
+
+	// updates of the addresses run while the challenges are presented and
+	// neither of them overwrites the other
+	var wg sync.WaitGroup
+	for i := 0; i < shared.MaxTXTRecords; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+			code, _ := serveAcme(t, f, "present", "_acme-challenge.pi.example.org", fmt.Sprintf("value%d", i), auth)
+			assert.Equal(t, 200, code)
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+			recorder := serve(f, "GET", fmt.Sprintf("/update/pi/secret?ipv4=10.0.1.%d", i), nil, nil)
+			assert.Equal(t, 200, recorder.Code)
+		}(i)
+	}
+	wg.Wait()
+
+	host := hosts.host(t, "pi")
+	assert.Len(t, host.TXT, shared.MaxTXTRecords)
+	assert.Contains(t, []string{"10.0.1.0", "10.0.1.1", "10.0.1.2", "10.0.1.3"}, host.IPv4.String())
+}
@@ -0,0 +1,104 @@
+package frontend
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/pboehm/ddns/shared"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAdminPageSize is the maximum number of hosts returned at once
+const maxAdminPageSize = 1000
+
+// authenticateAdmin checks the admin token passed as bearer token. The admin
+// API is disabled unless a token has been configured.
+func (f *Frontend) authenticateAdmin(c *gin.Context) bool {
+	if f.config.AdminToken == "" {
+		c.JSON(404, gin.H{"error": "The admin API is disabled"})
+		return false
+	}
+
+	header := c.GetHeader("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(f.config.AdminToken)) != 1 {
+		c.Header("WWW-Authenticate", `Bearer realm="DDNS"`)
+		c.JSON(401, gin.H{"error": "You have to supply the admin token"})
+		return false
+	}
+
+	return true
+}
+
+// handleAdminHosts returns a page of the hosts of the zone passed via `zone`,
+// which defaults to the default zone. The next page is requested by passing
+// the returned cursor via `cursor`.
+func (f *Frontend) handleAdminHosts(c *gin.Context) {
+	if !f.authenticateAdmin(c) {
+		return
+	}
+
+	zone := f.config.DefaultZone()
+	if zoneName := c.Query("zone"); zoneName != "" {
+		if zone = f.config.GetZone(zoneName); zone == nil {
+			c.JSON(404, gin.H{"error": "This zone does not exist"})
+			return
+		}
+	}
+
+	count, err := strconv.Atoi(c.DefaultQuery("count", "100"))
+	if err != nil || count <= 0 || count > maxAdminPageSize {
+		c.JSON(400, gin.H{"error": "The count has to be between 1 and 1000"})
+		return
+	}
+
+	hosts, next, err := f.hosts.ListHosts(c.Request.Context(), zone.Name, c.Query("cursor"), count)
+	if err != nil {
+		respondError(c, err, 500, "Could not list the hosts")
+		return
+	}
+
+	now := time.Now()
+	result := []gin.H{}
+
+	for _, host := range hosts {
+		result = append(result, gin.H{
+			"hostname":   host.Hostname,
+			"fqdn":       zone.Fqdn(host.Hostname),
+			"ipv4":       host.IPv4.String(),
+			"ipv6":       host.IPv6.String(),
+			"cname":      host.CNAME,
+			"ttl":        f.config.TTL(host.TTL),
+			"wildcard":   host.Wildcard,
+			"updated_at": optionalTime(host.UpdatedAt),
+			"expires_at": optionalTime(host.ExpiresAt),
+			"expires_in": expiresIn(host, now),
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"zone":   zone.Name,
+		"hosts":  result,
+		"cursor": next,
+	})
+}
+
+// optionalTime returns nil for unknown times, e.g. the last update of hosts
+// stored before it has been tracked
+func optionalTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+// expiresIn returns the seconds until the host expires or nil if unknown
+func expiresIn(host *shared.Host, now time.Time) interface{} {
+	if host.ExpiresAt.IsZero() {
+		return nil
+	}
+
+	return int(host.ExpiresAt.Sub(now).Seconds())
+}
@@ -0,0 +1,122 @@
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pboehm/ddns/shared"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// serveAdmin requests the hosts with the admin token and decodes the response
+func serveAdmin(t *testing.T, f *Frontend, query, token string) (int, map[string]interface{}) {
+	recorder := serve(f, "GET", "/admin/hosts?"+query, nil, map[string]string{"Authorization": "Bearer " + token})
+
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%s: invalid JSON %q", query, recorder.Body.String())
+	}
+	return recorder.Code, result
+}
+
+func TestAdminHosts(t *testing.T) {
+	f, hosts := buildFrontend(t)
+	f.config.AdminToken = "admin"
+	f.config.Zones = append(f.config.Zones, &shared.Zone{Name: "iot.example.org", SOAFqdn: "ns.example.org"})
+
+	ctx := context.Background()
+	updated := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	www := &shared.Host{Zone: "example.org", Hostname: "www", CNAME: "pi.example.org", TTL: 60, UpdatedAt: updated, ExpiresAt: updated.Add(48 * time.Hour)}
+	hosts.CreateHost(ctx, www)
+	hosts.CreateHost(ctx, &shared.Host{Zone: "iot.example.org", Hostname: "sensor"})
+
+	code, result := serveAdmin(t, f, "", "admin")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "example.org", result["zone"])
+	assert.Equal(t, "", result["cursor"])
+
+	list := result["hosts"].([]interface{})
+	if assert.Len(t, list, 2) {
+		pi := list[0].(map[string]interface{})
+		assert.Equal(t, "pi", pi["hostname"])
+		assert.Equal(t, "pi.example.org", pi["fqdn"])
+		assert.Equal(t, "10.0.0.1", pi["ipv4"])
+		assert.Equal(t, "2001:db8::1", pi["ipv6"])
+		assert.Equal(t, float64(5), pi["ttl"])
+
+		// the times of hosts are unknown until they have been stored
+		assert.Nil(t, pi["updated_at"])
+		assert.Nil(t, pi["expires_in"])
+
+		host := list[1].(map[string]interface{})
+		assert.Equal(t, "www", host["hostname"])
+		assert.Equal(t, "pi.example.org", host["cname"])
+		assert.Equal(t, float64(60), host["ttl"])
+		assert.Equal(t, updated.UTC().Format(time.RFC3339), host["updated_at"])
+		assert.Equal(t, updated.Add(48*time.Hour).UTC().Format(time.RFC3339), host["expires_at"])
+		assert.InDelta(t, 47*3600, host["expires_in"], 5)
+	}
+
+	code, result = serveAdmin(t, f, "zone=iot.example.org", "admin")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "iot.example.org", result["zone"])
+	assert.Len(t, result["hosts"], 1)
+}
+
+func TestAdminHostsPages(t *testing.T) {
+	f, hosts := buildFrontend(t)
+	f.config.AdminToken = "admin"
+
+	for i := 0; i < 4; i++ {
+		hosts.CreateHost(context.Background(), &shared.Host{Zone: "example.org", Hostname: fmt.Sprintf("host%d", i)})
+	}
+
+	names := []string{}
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		code, result := serveAdmin(t, f, "count=2&cursor="+cursor, "admin")
+		assert.Equal(t, 200, code)
+
+		for _, host := range result["hosts"].([]interface{}) {
+			names = append(names, host.(map[string]interface{})["hostname"].(string))
+		}
+
+		if cursor = result["cursor"].(string); cursor == "" {
+			break
+		}
+	}
+
+	assert.Equal(t, []string{"host0", "host1", "host2", "host3", "pi"}, names)
+
+	for _, count := range []string{"0", "-1", "1001", "many"} {
+		code, _ := serveAdmin(t, f, "count="+count, "admin")
+		assert.Equal(t, 400, code, count)
+	}
+}
+
+func TestAdminHostsErrors(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	// the admin API is disabled without a token
+	code, _ := serveAdmin(t, f, "", "")
+	assert.Equal(t, 404, code)
+
+	f.config.AdminToken = "admin"
+
+	code, _ = serveAdmin(t, f, "", "wrong")
+	assert.Equal(t, 401, code)
+
+	recorder := serve(f, "GET", "/admin/hosts", nil, map[string]string{"Authorization": "admin"})
+	assert.Equal(t, 401, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get("WWW-Authenticate"))
+
+	code, _ = serveAdmin(t, f, "zone=example.net", "admin")
+	assert.Equal(t, 404, code)
+
+	hosts.unavailable = true
+	code, _ = serveAdmin(t, f, "", "admin")
+	assert.Equal(t, 503, code)
+}
@@ -0,0 +1,196 @@
+package frontend
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/pboehm/ddns/shared"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDynDNSHostnames is the number of hostnames that can be updated with a
+// single request, which is the same limit that DynDNS enforces
+const maxDynDNSHostnames = 20
+
+// maxDynDNSUpdates is the number of updates of a host per minute, further
+// updates are answered with `abuse` until the next minute
+const maxDynDNSUpdates = 10
+
+// The return codes of the DynDNS2 protocol that are supported by us
+const (
+	dynDNSGood     = "good"
+	dynDNSNoChange = "nochg"
+	dynDNSBadAuth  = "badauth"
+	dynDNSNoHost   = "nohost"
+	dynDNSNotFqdn  = "notfqdn"
+	dynDNSNumHost  = "numhost"
+	dynDNSAbuse    = "abuse"
+	dynDNSError    = "911"
+)
+
+// updateLimiter counts the updates of every host within the current minute
+type updateLimiter struct {
+	mutex   sync.Mutex
+	minute  time.Time
+	updates map[string]int
+}
+
+// allow counts an update of the host and returns whether the host has been
+// updated less than maxDynDNSUpdates times within the current minute
+func (l *updateLimiter) allow(zone, hostname string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if minute := now.Truncate(time.Minute); !minute.Equal(l.minute) {
+		l.minute, l.updates = minute, map[string]int{}
+	}
+
+	l.updates[zone+"/"+hostname]++
+	return l.updates[zone+"/"+hostname] <= maxDynDNSUpdates
+}
+
+// handleNicUpdate implements the update API of DynDNS2, which is supported by
+// most routers and clients like ddclient. The hostnames are passed as a comma
+// separated list of FQDNs via `hostname` and the host token is used as the
+// password of the HTTP Basic authentication. The username has to be the FQDN
+// or the hostname of the updated hosts unless it is empty.
+func (f *Frontend) handleNicUpdate(c *gin.Context) {
+	username, token, ok := c.Request.BasicAuth()
+	if !ok || token == "" {
+		c.Header("WWW-Authenticate", `Basic realm="DDNS"`)
+		c.String(401, dynDNSBadAuth)
+		return
+	}
+
+	rawHostnames := c.Query("hostname")
+	if rawHostnames == "" {
+		// some clients only send the hostname as the username
+		rawHostnames = username
+	}
+
+	hostnames := strings.Split(rawHostnames, ",")
+	if len(hostnames) > maxDynDNSHostnames {
+		c.String(200, dynDNSNumHost)
+		return
+	}
+
+	// dual-stack clients can pass an IPv4 and an IPv6 address separated by comma,
+	// multiple addresses of the same family are all used
+	rawIps := c.Query("myip")
+	explicit := rawIps != ""
+	if !explicit {
+		var err error
+		if rawIps, err = extractRemoteAddr(c.Request, f.config); err != nil {
+			c.String(200, dynDNSError)
+			return
+		}
+	}
+
+	ips := strings.Split(rawIps, ",")
+	for _, ip := range ips {
+		if ipFamily(ip) == "" {
+			c.String(200, dynDNSError)
+			return
+		}
+	}
+
+	// all hosts are authenticated before any of them is updated and a wrong
+	// token fails the whole request, so that it is only checked once
+	ctx := c.Request.Context()
+	hosts := make([]*shared.Host, len(hostnames))
+	results := make([]string, len(hostnames))
+	for i, fqdn := range hostnames {
+		if hosts[i], results[i] = f.findDynDNSHost(ctx, fqdn); hosts[i] == nil {
+			continue
+		}
+
+		if _, ok := hosts[i].CheckToken(token); !ok || !f.matchesUsername(username, hosts[i]) {
+			c.String(200, dynDNSBadAuth)
+			return
+		}
+	}
+
+	for i, host := range hosts {
+		if host == nil {
+			continue
+		}
+
+		if !f.dynDNSUpdates.allow(host.Zone, host.Hostname, time.Now()) {
+			results[i] = dynDNSAbuse
+			continue
+		}
+
+		results[i] = f.updateDynDNSHost(ctx, host, token, ips, explicit)
+	}
+
+	c.String(200, strings.Join(results, "\n"))
+}
+
+// matchesUsername returns whether the username of the HTTP Basic authentication
+// is empty or names the host by its FQDN or its hostname
+func (f *Frontend) matchesUsername(username string, host *shared.Host) bool {
+	username = strings.TrimSuffix(username, ".")
+	fqdn := f.config.GetZone(host.Zone).Fqdn(host.Hostname)
+
+	return username == "" || strings.EqualFold(username, host.Hostname) || strings.EqualFold(username, fqdn)
+}
+
+// findDynDNSHost returns the host of the FQDN or the DynDNS2 return code why
+// it cannot be updated
+func (f *Frontend) findDynDNSHost(ctx context.Context, fqdn string) (*shared.Host, string) {
+	zone, hostname, valid := f.hostnameFromFqdn(fqdn)
+	if !valid {
+		return nil, dynDNSNotFqdn
+	}
+
+	host, err := f.hosts.GetHost(ctx, zone.Name, hostname)
+	if err == shared.ErrNotFound {
+		return nil, dynDNSNoHost
+	} else if err != nil {
+		return nil, dynDNSError
+	}
+
+	return host, ""
+}
+
+// updateDynDNSHost updates a single authenticated host and returns the DynDNS2
+// return code. The token is checked again against the current host, which may
+// have been changed since it was authenticated. Aliases are only renewed
+// unless the addresses have been passed explicitly.
+func (f *Frontend) updateDynDNSHost(ctx context.Context, host *shared.Host, token string, ips []string, explicit bool) string {
+	var code string
+
+	// the host is also written when nothing changed, so that it does not expire
+	_, err := f.updateHost(ctx, host.Zone, host.Hostname, token, func(host *shared.Host, _ string) error {
+		code = dynDNSNoChange
+		if host.CNAME != "" && !explicit {
+			return nil
+		}
+
+		previousIPv4, previousIPv6 := host.IPv4.String(), host.IPv6.String()
+		if err := host.SetIPs(ips); err != nil {
+			return err
+		}
+
+		if host.IPv4.String() != previousIPv4 || host.IPv6.String() != previousIPv6 {
+			code = dynDNSGood
+		}
+		return nil
+	})
+
+	switch {
+	case err == errWrongToken:
+		return dynDNSBadAuth
+	case err == shared.ErrNotFound:
+		return dynDNSNoHost
+	case err != nil:
+		if f.config.Verbose {
+			log.Printf("Could not update host %s: %v", host.Hostname, err)
+		}
+		return dynDNSError
+	}
+
+	return code + " " + strings.Join(ips, ",")
+}
@@ -0,0 +1,179 @@
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"github.com/pboehm/ddns/shared"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nicUpdate sends a DynDNS2 update with the credentials and returns the
+// status code and the body of the response
+func nicUpdate(f *Frontend, query, username, password string) (int, string) {
+	recorder := serve(f, "GET", "/nic/update?"+query, nil, basicAuth(username, password))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestNicUpdate(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	code, body := nicUpdate(f, "hostname=pi.example.org&myip=10.0.0.2", "pi", "secret")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "good 10.0.0.2", body)
+	assert.Equal(t, shared.Addresses{"10.0.0.2"}, hosts.host(t, "pi").IPv4)
+	assert.Equal(t, shared.Addresses{"2001:db8::1"}, hosts.host(t, "pi").IPv6)
+
+	_, body = nicUpdate(f, "hostname=pi.example.org&myip=10.0.0.2", "pi", "secret")
+	assert.Equal(t, "nochg 10.0.0.2", body)
+
+	// dual-stack clients pass both addresses
+	_, body = nicUpdate(f, "hostname=pi.example.org&myip=10.0.0.3,2001:db8::2", "pi", "secret")
+	assert.Equal(t, "good 10.0.0.3,2001:db8::2", body)
+	assert.Equal(t, shared.Addresses{"2001:db8::2"}, hosts.host(t, "pi").IPv6)
+
+	// the address of the client is used without myip and the hostname can be
+	// passed as the username
+	_, body = nicUpdate(f, "", "pi.example.org", "secret")
+	assert.Equal(t, "good 192.0.2.1", body)
+	assert.Equal(t, shared.Addresses{"192.0.2.1"}, hosts.host(t, "pi").IPv4)
+
+	_, body = nicUpdate(f, "hostname=pi.example.org&myip=invalid", "pi", "secret")
+	assert.Equal(t, "911", body)
+}
+
+func TestNicUpdateErrors(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	recorder := serve(f, "GET", "/nic/update?hostname=pi.example.org", nil, nil)
+	assert.Equal(t, 401, recorder.Code)
+	assert.Equal(t, "badauth", recorder.Body.String())
+	assert.NotEmpty(t, recorder.Header().Get("WWW-Authenticate"))
+
+	code, body := nicUpdate(f, "hostname=pi.example.org&myip=10.0.0.2", "pi", "wrong")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "badauth", body)
+	assert.Equal(t, shared.Addresses{"10.0.0.1"}, hosts.host(t, "pi").IPv4)
+
+	_, body = nicUpdate(f, "hostname=notexisting.example.org&myip=10.0.0.2", "pi", "secret")
+	assert.Equal(t, "nohost", body)
+
+	for _, hostname := range []string{"pi", "pi.example.net", "in_valid.example.org"} {
+		_, body = nicUpdate(f, "hostname="+hostname+"&myip=10.0.0.2", "pi", "secret")
+		assert.Equal(t, "notfqdn", body, hostname)
+	}
+
+	hosts.unavailable = true
+	_, body = nicUpdate(f, "hostname=pi.example.org&myip=10.0.0.2", "pi", "secret")
+	assert.Equal(t, "911", body)
+}
+
+func TestNicUpdateMultipleHosts(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	nas := &shared.Host{Zone: "example.org", Hostname: "nas", IPv4: shared.Addresses{"10.0.0.2"}}
+	nas.SetToken(shared.DefaultTokenName, "secret")
+	hosts.CreateHost(context.Background(), nas)
+
+	// every hostname gets its own return code, where the username is empty
+	// because it cannot name all hosts
+	_, body := nicUpdate(f, "hostname=pi.example.org,nas.example.org,notexisting.example.org,invalid&myip=10.0.0.2", "", "secret")
+	assert.Equal(t, "good 10.0.0.2\nnochg 10.0.0.2\nnohost\nnotfqdn", body)
+	assert.Equal(t, shared.Addresses{"10.0.0.2"}, hosts.host(t, "pi").IPv4)
+
+	hostnames := []string{}
+	for i := 0; i <= maxDynDNSHostnames; i++ {
+		hostnames = append(hostnames, fmt.Sprintf("host%d.example.org", i))
+	}
+
+	code, body := nicUpdate(f, "hostname="+strings.Join(hostnames, ",")+"&myip=10.0.0.3", "", "secret")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "numhost", body)
+
+	_, body = nicUpdate(f, "hostname="+strings.Join(hostnames[1:], ",")+"&myip=10.0.0.3", "", "secret")
+	assert.Equal(t, strings.TrimSuffix(strings.Repeat("nohost\n", maxDynDNSHostnames), "\n"), body)
+}
+
+func TestNicUpdateKeepsCNAME(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	host := hosts.host(t, "pi")
+	host.SetCNAME("lb.example.net")
+	hosts.SetHost(context.Background(), host)
+
+	auth := basicAuth("pi", "secret")
+
+	recorder := serve(f, "GET", "/nic/update?hostname=pi.example.org", nil, auth)
+	assert.Equal(t, 200, recorder.Code)
+	assert.True(t, strings.HasPrefix(recorder.Body.String(), "nochg"))
+	assert.Equal(t, "lb.example.net", hosts.host(t, "pi").CNAME)
+
+	recorder = serve(f, "GET", "/nic/update?hostname=pi.example.org&myip=10.0.0.2", nil, auth)
+	assert.Equal(t, "good 10.0.0.2", recorder.Body.String())
+	assert.Equal(t, "", hosts.host(t, "pi").CNAME)
+}
+
+func TestNicUpdateChecksTokenOnce(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	nas := &shared.Host{Zone: "example.org", Hostname: "nas", IPv4: shared.Addresses{"10.0.0.3"}}
+	nas.SetToken(shared.DefaultTokenName, "other")
+	hosts.CreateHost(context.Background(), nas)
+
+	// a token that is wrong for one of the hosts fails the whole request
+	recorder := serve(f, "GET", "/nic/update?hostname=pi.example.org,nas.example.org&myip=10.0.0.2", nil, basicAuth("", "secret"))
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "badauth", recorder.Body.String())
+	assert.Equal(t, shared.Addresses{"10.0.0.1"}, hosts.host(t, "pi").IPv4)
+	assert.Equal(t, shared.Addresses{"10.0.0.3"}, hosts.host(t, "nas").IPv4)
+}
+
+func TestNicUpdateChecksUsername(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	nas := &shared.Host{Zone: "example.org", Hostname: "nas", IPv4: shared.Addresses{"10.0.0.3"}}
+	nas.SetToken(shared.DefaultTokenName, "secret")
+	hosts.CreateHost(context.Background(), nas)
+
+	// the username has to name the updated host
+	_, body := nicUpdate(f, "hostname=pi.example.org&myip=10.0.0.2", "nas", "secret")
+	assert.Equal(t, "badauth", body)
+
+	_, body = nicUpdate(f, "hostname=pi.example.org,nas.example.org&myip=10.0.0.2", "nas.example.org", "secret")
+	assert.Equal(t, "badauth", body)
+	assert.Equal(t, shared.Addresses{"10.0.0.1"}, hosts.host(t, "pi").IPv4)
+	assert.Equal(t, shared.Addresses{"10.0.0.3"}, hosts.host(t, "nas").IPv4)
+
+	for _, username := range []string{"pi", "PI.example.org.", ""} {
+		_, body = nicUpdate(f, "hostname=pi.example.org&myip=10.0.0.2", username, "secret")
+		assert.True(t, strings.HasSuffix(body, " 10.0.0.2"), username)
+	}
+}
+
+func TestNicUpdateAbuse(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	_, body := nicUpdate(f, "hostname=pi.example.org&myip=10.0.0.2", "pi", "secret")
+	assert.Equal(t, "good 10.0.0.2", body)
+
+	for i := 1; i < maxDynDNSUpdates; i++ {
+		f.dynDNSUpdates.allow("example.org", "pi", time.Now())
+	}
+
+	// further updates within the same minute are rejected
+	_, body = nicUpdate(f, "hostname=pi.example.org&myip=10.0.0.3", "pi", "secret")
+	assert.Equal(t, "abuse", body)
+	assert.Equal(t, shared.Addresses{"10.0.0.2"}, hosts.host(t, "pi").IPv4)
+
+	// the limit is reset every minute
+	limiter := &updateLimiter{}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < maxDynDNSUpdates; i++ {
+		assert.True(t, limiter.allow("example.org", "pi", now))
+	}
+	assert.False(t, limiter.allow("example.org", "pi", now.Add(59*time.Second)))
+	assert.True(t, limiter.allow("example.org", "nas", now))
+	assert.True(t, limiter.allow("example.org", "pi", now.Add(time.Minute)))
+}
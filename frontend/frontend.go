@@ -1,6 +1,8 @@
 package frontend
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/pboehm/ddns/shared"
@@ -9,21 +11,33 @@ import (
 	"net"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 type Frontend struct {
 	config *shared.Config
 	hosts  shared.HostBackend
+
+	// dynDNSUpdates limits the rate of updates via /nic/update
+	dynDNSUpdates *updateLimiter
 }
 
 func NewFrontend(config *shared.Config, hosts shared.HostBackend) *Frontend {
 	return &Frontend{
-		config: config,
-		hosts:  hosts,
+		config:        config,
+		hosts:         hosts,
+		dynDNSUpdates: &updateLimiter{},
 	}
 }
 
-func (f *Frontend) Run() error {
+// Run serves the frontend until the context is canceled
+func (f *Frontend) Run(ctx context.Context) error {
+	return shared.ListenAndServe(ctx, f.config.ListenFrontend, f.router())
+}
+
+// router builds the handler of all routes of the frontend
+func (f *Frontend) router() *gin.Engine {
 	r := gin.New()
 	r.Use(gin.Recovery())
 
@@ -34,15 +48,24 @@ func (f *Frontend) Run() error {
 	r.SetHTMLTemplate(buildTemplate())
 
 	r.GET("/", func(g *gin.Context) {
-		g.HTML(200, "index.html", gin.H{"domain": f.config.Domain})
+		zones := []string{}
+		for _, zone := range f.config.Zones {
+			zones = append(zones, zone.Name)
+		}
+
+		g.HTML(200, "index.html", gin.H{"zones": zones})
 	})
 
 	r.GET("/available/:hostname", func(c *gin.Context) {
-		hostname, valid := isValidHostname(c.Params.ByName("hostname"))
+		zone, hostname, valid := f.zoneAndHostname(c)
 
 		if valid {
-			_, err := f.hosts.GetHost(hostname)
-			valid = err != nil
+			_, err := f.hosts.GetHost(c.Request.Context(), zone.Name, hostname)
+			if err == shared.ErrUnavailable {
+				respondError(c, err, 503, "")
+				return
+			}
+			valid = err == shared.ErrNotFound
 		}
 
 		c.JSON(200, gin.H{
@@ -51,94 +74,496 @@ func (f *Frontend) Run() error {
 	})
 
 	r.GET("/new/:hostname", func(c *gin.Context) {
-		hostname, valid := isValidHostname(c.Params.ByName("hostname"))
+		zone, hostname, valid := f.zoneAndHostname(c)
 
 		if !valid {
 			c.JSON(404, gin.H{"error": "This hostname is not valid"})
 			return
 		}
 
-		var err error
+		host := &shared.Host{Zone: zone.Name, Hostname: hostname, IPv4: shared.Addresses{"127.0.0.1"}}
 
-		if _, err := f.hosts.GetHost(hostname); err == nil {
-			c.JSON(403, gin.H{"error": "This hostname has already been registered."})
+		token, err := host.GenerateAndSetToken(shared.DefaultTokenName)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Could not register host."})
 			return
 		}
 
-		host := &shared.Host{Hostname: hostname, Ip: "127.0.0.1"}
-		host.GenerateAndSetToken()
-
-		if err = f.hosts.SetHost(host); err != nil {
-			c.JSON(400, gin.H{"error": "Could not register host."})
+		if err = f.hosts.CreateHost(c.Request.Context(), host); err == shared.ErrHostExists {
+			c.JSON(409, gin.H{"error": "This hostname has already been registered."})
+			return
+		} else if err != nil {
+			respondError(c, err, 400, "Could not register host.")
 			return
 		}
 
 		c.JSON(200, gin.H{
 			"hostname":    host.Hostname,
-			"token":       host.Token,
-			"update_link": fmt.Sprintf("/update/%s/%s", host.Hostname, host.Token),
+			"zone":        host.Zone,
+			"token":       token,
+			"update_link": fmt.Sprintf("/update/%s/%s", zone.Fqdn(host.Hostname), token),
 		})
 	})
 
 	r.GET("/update/:hostname/:token", func(c *gin.Context) {
-		hostname, valid := isValidHostname(c.Params.ByName("hostname"))
-		token := c.Params.ByName("token")
-
-		if !valid {
-			c.JSON(404, gin.H{"error": "This hostname is not valid"})
-			return
+		ttl := -1
+		if rawTTL := c.Query("ttl"); rawTTL != "" {
+			var err error
+			if ttl, err = strconv.Atoi(rawTTL); err != nil || !f.config.ValidTTL(ttl) {
+				c.JSON(400, gin.H{
+					"error": fmt.Sprintf("The TTL has to be between %d and %d seconds or 0 for the default",
+						f.config.MinTTL, f.config.MaxTTL),
+				})
+				return
+			}
 		}
 
-		host, err := f.hosts.GetHost(hostname)
-		if err != nil {
-			c.JSON(404, gin.H{
-				"error": "This hostname has not been registered or is expired.",
-			})
-			return
+		var wildcard *bool
+		if rawWildcard := c.Query("wildcard"); rawWildcard != "" {
+			value, err := strconv.ParseBool(rawWildcard)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "The wildcard flag has to be true or false"})
+				return
+			}
+
+			wildcard = &value
 		}
 
-		if host.Token != token {
-			c.JSON(403, gin.H{
-				"error": "You have supplied the wrong token to manipulate this host",
-			})
+		var changed []string
+
+		host, ok := f.updateRequestedHost(c, "Could not update registered IP address", func(host *shared.Host, _ string) error {
+			if ttl >= 0 {
+				host.TTL = ttl
+			}
+
+			if wildcard != nil {
+				host.Wildcard = *wildcard
+			}
+
+			previousIPv4, previousIPv6, previousCNAME := host.IPv4.String(), host.IPv6.String(), host.CNAME
+
+			if err := f.applyRecordParams(c, host); err != nil {
+				return err
+			}
+
+			changed = []string{}
+			if host.IPv4.String() != previousIPv4 {
+				changed = append(changed, "ipv4")
+			}
+			if host.IPv6.String() != previousIPv6 {
+				changed = append(changed, "ipv6")
+			}
+			if host.CNAME != previousCNAME {
+				changed = append(changed, "cname")
+			}
+
+			return nil
+		})
+		if !ok {
 			return
 		}
 
-		ip, err := extractRemoteAddr(c.Request)
-		if err != nil {
-			c.JSON(400, gin.H{
-				"error": "Your sender IP address is not in the right format",
-			})
+		c.JSON(200, gin.H{
+			"ipv4":     host.IPv4.String(),
+			"ipv6":     host.IPv6.String(),
+			"cname":    host.CNAME,
+			"ttl":      f.config.TTL(host.TTL),
+			"wildcard": host.Wildcard,
+			"changed":  changed,
+			"status":   "Successfuly updated",
+		})
+	})
+
+	r.DELETE("/delete/:hostname/:token", func(c *gin.Context) {
+		host, _, ok := f.authenticateHost(c)
+		if !ok {
 			return
 		}
 
-		host.Ip = ip
-		if err = f.hosts.SetHost(host); err != nil {
-			c.JSON(400, gin.H{
-				"error": "Could not update registered IP address",
-			})
+		if err := f.hosts.DeleteHost(c.Request.Context(), host.Zone, host.Hostname); err != nil {
+			respondError(c, err, 400, "Could not release the host")
+			return
 		}
 
 		c.JSON(200, gin.H{
-			"current_ip": ip,
-			"status":     "Successfuly updated",
+			"hostname": host.Hostname,
+			"zone":     host.Zone,
+			"status":   "Successfully released",
+		})
+	})
+
+	// management of the named tokens of a host
+	r.GET("/token/list/:hostname/:token", f.handleTokenList)
+	r.POST("/token/new/:hostname/:token", f.handleTokenNew)
+	r.POST("/token/rotate/:hostname/:token", f.handleTokenRotate)
+	r.POST("/token/revoke/:hostname/:token", f.handleTokenRevoke)
+
+	// MX and SRV records of a host
+	r.GET("/records/:hostname/:token", f.handleRecordsList)
+	r.PUT("/records/:hostname/:token", f.handleRecordsSet)
+
+	// admin API authenticated by the token passed via --admin-token
+	r.GET("/admin/hosts", f.handleAdminHosts)
+
+	// DynDNS2 compatible API used by routers and clients like ddclient
+	r.GET("/nic/update", f.handleNicUpdate)
+
+	// ACME DNS-01 challenges compatible with the lego "httpreq" provider
+	r.POST("/acme/present", f.handleAcmePresent)
+	r.POST("/acme/cleanup", f.handleAcmeCleanup)
+
+	return r
+}
+
+// authenticateHost returns the host addressed by the `hostname` parameter and
+// the name of the token if the `token` parameter is valid for the host.
+// Otherwise an error is sent to the client.
+func (f *Frontend) authenticateHost(c *gin.Context) (*shared.Host, string, bool) {
+	zone, hostname, valid := f.zoneAndHostname(c)
+	token := c.Params.ByName("token")
+
+	if !valid {
+		c.JSON(404, gin.H{"error": "This hostname is not valid"})
+		return nil, "", false
+	}
+
+	host, err := f.hosts.GetHost(c.Request.Context(), zone.Name, hostname)
+	if err != nil {
+		respondError(c, err, 404, "This hostname has not been registered or is expired.")
+		return nil, "", false
+	}
+
+	name, ok := host.CheckToken(token)
+	if !ok {
+		c.JSON(403, gin.H{
+			"error": "You have supplied the wrong token to manipulate this host",
 		})
+		return nil, "", false
+	}
+
+	return host, name, true
+}
+
+// errWrongToken is returned by updateHost if the token is not valid for the
+// current host
+var errWrongToken = &requestError{403, "You have supplied the wrong token to manipulate this host"}
+
+// requestError is an error caused by the request, which is sent to the client
+// with its status code by respondError
+type requestError struct {
+	code    int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// updateHost checks the token against the current host within the storage and
+// applies the change to it, so that concurrent requests never write back a
+// stale copy of the host, e.g. a revoked token or the TXT value of an ACME
+// challenge. The change receives the name of the token and is called again if
+// the host has been changed in the meantime. Errors of the change are returned
+// as requestError with 400 unless they are a requestError already.
+func (f *Frontend) updateHost(ctx context.Context, zone, hostname, token string, change func(host *shared.Host, name string) error) (*shared.Host, error) {
+	var updated *shared.Host
+
+	err := f.hosts.UpdateHost(ctx, zone, hostname, func(host *shared.Host) error {
+		name, ok := host.CheckToken(token)
+		if !ok {
+			return errWrongToken
+		}
+
+		if err := change(host, name); err != nil {
+			if _, ok := err.(*requestError); ok {
+				return err
+			}
+			return &requestError{400, err.Error()}
+		}
+
+		updated = host
+		return nil
 	})
 
-	return r.Run(f.config.ListenFrontend)
+	return updated, err
+}
+
+// updateRequestedHost applies the change to the host addressed by the
+// `hostname` parameter using updateHost with the `token` parameter. Errors are
+// sent to the client, where the message is used for errors of the storage.
+func (f *Frontend) updateRequestedHost(c *gin.Context, message string, change func(host *shared.Host, name string) error) (*shared.Host, bool) {
+	zone, hostname, valid := f.zoneAndHostname(c)
+	if !valid {
+		c.JSON(404, gin.H{"error": "This hostname is not valid"})
+		return nil, false
+	}
+
+	host, err := f.updateHost(c.Request.Context(), zone.Name, hostname, c.Params.ByName("token"), change)
+	if err != nil {
+		respondError(c, err, 400, message)
+		return nil, false
+	}
+
+	return host, true
+}
+
+// respondError sends the error message with the status code, unless the host
+// storage is unavailable, which results in 503 because the outcome is unknown,
+// or the host has been released or has expired in the meantime, which results
+// in 404. A requestError is sent with its own status code and message.
+func respondError(c *gin.Context, err error, code int, message string) {
+	if requestErr, ok := err.(*requestError); ok {
+		code, message = requestErr.code, requestErr.message
+	} else if err == shared.ErrUnavailable {
+		code, message = 503, "The service is temporarily unavailable, please try again later"
+	} else if err == shared.ErrNotFound {
+		code, message = 404, "This hostname has not been registered or is expired."
+	}
+
+	c.JSON(code, gin.H{"error": message})
+}
+
+// applyRecordParams makes the host an alias of the target passed via `cname`,
+// which cannot be combined with addresses. Passing `cname=none` turns an alias
+// back into a host with addresses, which are applied by applyAddressParams.
+// Aliases updated without any parameter are only renewed.
+func (f *Frontend) applyRecordParams(c *gin.Context, host *shared.Host) error {
+	cname := c.Query("cname")
+	addresses := c.Query("ip") != "" || c.Query("ipv4") != "" || c.Query("ipv6") != ""
+
+	if cname == "" {
+		if host.CNAME != "" && !addresses {
+			return nil
+		}
+
+		return f.applyAddressParams(c, host)
+	}
+
+	if addresses {
+		return errors.New("A host cannot have a CNAME and IP addresses at the same time")
+	}
+
+	if cname == "none" {
+		host.CNAME = ""
+		return f.applyAddressParams(c, host)
+	}
+
+	if err := host.SetCNAME(cname); err != nil {
+		return errors.New("The supplied CNAME target is not a valid FQDN")
+	}
+
+	return nil
+}
+
+// applyAddressParams updates the addresses of the host according to the query
+// parameters of the request. `ip` sets the addresses of their families, `ipv4`
+// and `ipv6` set the addresses of the respective family or clear them when
+// `none` is passed. Multiple addresses are separated by comma and the value
+// `auto` refers to the sender address, which is used as `ip` if no parameter
+// has been supplied.
+func (f *Frontend) applyAddressParams(c *gin.Context, host *shared.Host) error {
+	ip, ipv4, ipv6 := c.Query("ip"), c.Query("ipv4"), c.Query("ipv6")
+	if ip == "" && ipv4 == "" && ipv6 == "" {
+		ip = "auto"
+	}
+
+	resolve := func(value string) ([]string, error) {
+		addresses := strings.Split(value, ",")
+		for i, address := range addresses {
+			if address != "auto" {
+				continue
+			}
+
+			remote, err := extractRemoteAddr(c.Request, f.config)
+			if err != nil || ipFamily(remote) == "" {
+				return nil, errors.New("Your sender IP address is not in the right format")
+			}
+			addresses[i] = remote
+		}
+
+		return addresses, nil
+	}
+
+	if ip != "" {
+		addresses, err := resolve(ip)
+		if err != nil {
+			return err
+		}
+
+		if err = host.SetIPs(addresses); err != nil {
+			return fmt.Errorf("The supplied IP addresses are not valid: %v", err)
+		}
+	}
+
+	for family, value := range map[string]string{"ipv4": ipv4, "ipv6": ipv6} {
+		if value == "" {
+			continue
+		}
+
+		if value == "none" {
+			if family == "ipv4" {
+				host.IPv4 = nil
+			} else {
+				host.IPv6 = nil
+			}
+			continue
+		}
+
+		addresses, err := resolve(value)
+		if err != nil {
+			return err
+		}
+
+		for _, address := range addresses {
+			if ipFamily(address) != family {
+				return fmt.Errorf("The supplied %s address is not valid", family)
+			}
+		}
+
+		if err = host.SetIPs(addresses); err != nil {
+			return fmt.Errorf("The supplied %s addresses are not valid: %v", family, err)
+		}
+	}
+
+	return nil
+}
+
+// zoneAndHostname determines the zone and the hostname of the request. The
+// hostname can either be a FQDN within one of our zones or a bare hostname,
+// which belongs to the zone passed via `zone` or the default zone otherwise.
+func (f *Frontend) zoneAndHostname(c *gin.Context) (*shared.Zone, string, bool) {
+	name := c.Params.ByName("hostname")
+	if strings.Contains(name, ".") {
+		return f.hostnameFromFqdn(name)
+	}
+
+	zone := f.config.DefaultZone()
+	if zoneName := c.Query("zone"); zoneName != "" {
+		if zone = f.config.GetZone(zoneName); zone == nil {
+			return nil, "", false
+		}
+	}
+
+	hostname, valid := isValidHostname(name)
+	return zone, hostname, valid
+}
+
+// hostnameFromFqdn determines the zone of the supplied FQDN and validates the
+// remaining hostname: pi.d.example.org -> d.example.org, pi
+func (f *Frontend) hostnameFromFqdn(fqdn string) (*shared.Zone, string, bool) {
+	fqdn = strings.TrimSpace(fqdn)
+
+	zone := f.config.FindZone(fqdn)
+	if zone == nil {
+		return nil, "", false
+	}
+
+	hostname, _ := zone.Hostname(fqdn)
+	hostname, valid := isValidHostname(hostname)
+	return zone, hostname, valid
+}
+
+// Get the Remote Address of the client. If the request has been sent by one of
+// the trusted proxies, the forwarding headers are used in the order Forwarded,
+// X-Forwarded-For and X-Real-IP. The forwarded addresses are evaluated from
+// right to left and the first one that is not a trusted proxy is the client,
+// unless a hop is unknown, in which case the last known hop is the client.
+func extractRemoteAddr(req *http.Request, config *shared.Config) (string, error) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return "", errors.New("Invalid remote address")
+	}
+
+	if !config.IsTrustedProxy(remote) {
+		return remote.String(), nil
+	}
+
+	var forwarded []string
+	if values, ok := req.Header["Forwarded"]; ok {
+		if forwarded, err = parseForwardedHeader(values); err != nil {
+			return "", err
+		}
+	} else if values, ok := req.Header["X-Forwarded-For"]; ok {
+		for _, value := range values {
+			for _, address := range strings.Split(value, ",") {
+				forwarded = append(forwarded, strings.TrimSpace(address))
+			}
+		}
+	} else if value := req.Header.Get("X-Real-IP"); value != "" {
+		forwarded = []string{strings.TrimSpace(value)}
+	}
+
+	client := remote
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		// proxies may hide the previous hop behind `unknown` or an obfuscated
+		// identifier like `_hidden` (RFC 7239), so that the last known hop is used
+		if strings.EqualFold(forwarded[i], "unknown") || strings.HasPrefix(forwarded[i], "_") {
+			break
+		}
+
+		hop := net.ParseIP(forwarded[i])
+		if hop == nil {
+			return "", fmt.Errorf("Invalid forwarded address %q", forwarded[i])
+		}
+
+		if client = hop; !config.IsTrustedProxy(client) {
+			break
+		}
+	}
+
+	return client.String(), nil
+}
+
+// parseForwardedHeader returns the addresses of the `for` parameters of the
+// Forwarded header (RFC 7239) without the optional port
+func parseForwardedHeader(values []string) ([]string, error) {
+	addresses := []string{}
+
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				keyValue := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(keyValue) != 2 || strings.ToLower(keyValue[0]) != "for" {
+					continue
+				}
+
+				address := strings.Trim(keyValue[1], "\"")
+				if strings.HasPrefix(address, "[") {
+					// IPv6 addresses are enclosed in brackets: "[2001:db8::1]:4711"
+					end := strings.Index(address, "]")
+					if end < 0 {
+						return nil, fmt.Errorf("Invalid forwarded address %q", address)
+					}
+					address = address[1:end]
+				} else if host, _, err := net.SplitHostPort(address); err == nil {
+					address = host
+				}
+
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	return addresses, nil
 }
 
-// Get the Remote Address of the client. At First we try to get the
-// X-Forwarded-For Header which holds the IP if we are behind a proxy,
-// otherwise the RemoteAddr is used
-func extractRemoteAddr(req *http.Request) (string, error) {
-	header_data, ok := req.Header["X-Forwarded-For"]
+// ipFamily returns `ipv4` or `ipv6` depending on the address family of the
+// supplied IP address or an empty string if it is not a valid IP address
+func ipFamily(rawIp string) string {
+	ip := net.ParseIP(rawIp)
 
-	if ok {
-		return header_data[0], nil
-	} else {
-		ip, _, err := net.SplitHostPort(req.RemoteAddr)
-		return ip, err
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return "ipv4"
+	default:
+		return "ipv6"
 	}
 }
 
@@ -0,0 +1,587 @@
+package frontend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/pboehm/ddns/shared"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testHostBackend stores copies of the hosts in memory, so that handlers only
+// change stored hosts by writing them
+type testHostBackend struct {
+	mutex sync.Mutex
+	hosts map[string]*shared.Host
+
+	// unavailable simulates a storage outage
+	unavailable bool
+}
+
+func copyHost(host *shared.Host) *shared.Host {
+	data, _ := json.Marshal(host)
+	copied := &shared.Host{ExpiresAt: host.ExpiresAt}
+	json.Unmarshal(data, copied)
+	return copied
+}
+
+func (b *testHostBackend) GetHost(ctx context.Context, zone, hostname string) (*shared.Host, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.unavailable {
+		return nil, shared.ErrUnavailable
+	}
+
+	host, ok := b.hosts[zone+"/"+hostname]
+	if !ok {
+		return nil, shared.ErrNotFound
+	}
+	return copyHost(host), nil
+}
+
+func (b *testHostBackend) CreateHost(ctx context.Context, host *shared.Host) error {
+	return b.storeHost(host, true)
+}
+
+func (b *testHostBackend) SetHost(ctx context.Context, host *shared.Host) error {
+	return b.storeHost(host, false)
+}
+
+func (b *testHostBackend) storeHost(host *shared.Host, create bool) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.unavailable {
+		return shared.ErrUnavailable
+	}
+
+	key := host.Zone + "/" + host.Hostname
+	if _, exists := b.hosts[key]; exists && create {
+		return shared.ErrHostExists
+	} else if !exists && !create {
+		return shared.ErrNotFound
+	}
+
+	b.hosts[key] = copyHost(host)
+	return nil
+}
+
+func (b *testHostBackend) UpdateHost(ctx context.Context, zone, hostname string, update func(*shared.Host) error) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.unavailable {
+		return shared.ErrUnavailable
+	}
+
+	stored, exists := b.hosts[zone+"/"+hostname]
+	if !exists {
+		return shared.ErrNotFound
+	}
+
+	host := copyHost(stored)
+	if err := update(host); err != nil {
+		return err
+	}
+
+	b.hosts[zone+"/"+hostname] = copyHost(host)
+	return nil
+}
+
+func (b *testHostBackend) DeleteHost(ctx context.Context, zone, hostname string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.unavailable {
+		return shared.ErrUnavailable
+	}
+
+	if _, exists := b.hosts[zone+"/"+hostname]; !exists {
+		return shared.ErrNotFound
+	}
+
+	delete(b.hosts, zone+"/"+hostname)
+	return nil
+}
+
+func (b *testHostBackend) ListHosts(ctx context.Context, zone, cursor string, count int) ([]*shared.Host, string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.unavailable {
+		return nil, "", shared.ErrUnavailable
+	}
+
+	names := []string{}
+	for _, host := range b.hosts {
+		if host.Zone == zone && host.Hostname > cursor {
+			names = append(names, host.Hostname)
+		}
+	}
+	sort.Strings(names)
+
+	next := ""
+	if len(names) > count {
+		names, next = names[:count], names[count-1]
+	}
+
+	hosts := []*shared.Host{}
+	for _, name := range names {
+		hosts = append(hosts, copyHost(b.hosts[zone+"/"+name]))
+	}
+	return hosts, next, nil
+}
+
+func (b *testHostBackend) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	return 2020010100, nil
+}
+
+// host returns the stored host, which fails the test if it does not exist
+func (b *testHostBackend) host(t *testing.T, hostname string) *shared.Host {
+	host, err := b.GetHost(context.Background(), "example.org", hostname)
+	if err != nil {
+		t.Fatalf("host %s: %v", hostname, err)
+	}
+	return host
+}
+
+func buildConfig(trustedProxies ...string) *shared.Config {
+	config := &shared.Config{}
+	for _, cidr := range trustedProxies {
+		_, network, _ := net.ParseCIDR(cidr)
+		config.TrustedProxies = append(config.TrustedProxies, network)
+	}
+	return config
+}
+
+// buildFrontend returns a frontend for the zone example.org, which has the host
+// `pi` with the token `secret` and the addresses 10.0.0.1 and 2001:db8::1
+func buildFrontend(t *testing.T) (*Frontend, *testHostBackend) {
+	config := buildConfig()
+	config.Zones = []*shared.Zone{{Name: "example.org", SOAFqdn: "ns.example.org"}}
+	config.MinTTL, config.MaxTTL, config.DefaultTTL = 5, 86400, 5
+
+	pi := &shared.Host{
+		Zone:     "example.org",
+		Hostname: "pi",
+		IPv4:     shared.Addresses{"10.0.0.1"},
+		IPv6:     shared.Addresses{"2001:db8::1"},
+	}
+	if err := pi.SetToken(shared.DefaultTokenName, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := &testHostBackend{hosts: map[string]*shared.Host{}}
+	hosts.CreateHost(context.Background(), pi)
+
+	return NewFrontend(config, hosts), hosts
+}
+
+// serve sends the request with the remote address 192.0.2.1 and returns the
+// recorded response
+func serve(f *Frontend, method, url string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, body)
+	req.RemoteAddr = "192.0.2.1:1234"
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	recorder := httptest.NewRecorder()
+	f.router().ServeHTTP(recorder, req)
+	return recorder
+}
+
+// serveJSON sends the request and decodes the JSON response
+func serveJSON(t *testing.T, f *Frontend, method, url string) (int, map[string]interface{}) {
+	recorder := serve(f, method, url, nil, nil)
+
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%s %s: invalid JSON %q", method, url, recorder.Body.String())
+	}
+	return recorder.Code, result
+}
+
+// basicAuth returns the header of the HTTP Basic authentication
+func basicAuth(username, password string) map[string]string {
+	return map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))}
+}
+
+func buildHTTPRequest(remoteAddr string, headers map[string]string) *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	for key, value := range headers {
+		req.Header.Add(key, value)
+	}
+	return req
+}
+
+func TestExtractRemoteAddr(t *testing.T) {
+	config := buildConfig("10.0.0.0/8", "fd00::/8")
+
+	// headers of untrusted clients are ignored
+	ip, err := extractRemoteAddr(buildHTTPRequest("1.2.3.4:1234", map[string]string{
+		"X-Forwarded-For": "5.6.7.8",
+	}), config)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.4", ip)
+
+	ip, err = extractRemoteAddr(buildHTTPRequest("[2001:db8::1]:1234", nil), config)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", ip)
+
+	ip, err = extractRemoteAddr(buildHTTPRequest("10.0.0.1:1234", nil), config)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", ip)
+
+	ip, err = extractRemoteAddr(buildHTTPRequest("10.0.0.1:1234", map[string]string{
+		"X-Forwarded-For": "5.6.7.8",
+	}), config)
+	assert.Nil(t, err)
+	assert.Equal(t, "5.6.7.8", ip)
+
+	// addresses added by the client itself are skipped
+	ip, err = extractRemoteAddr(buildHTTPRequest("10.0.0.1:1234", map[string]string{
+		"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.0.0.2",
+	}), config)
+	assert.Nil(t, err)
+	assert.Equal(t, "5.6.7.8", ip)
+
+	ip, err = extractRemoteAddr(buildHTTPRequest("10.0.0.1:1234", map[string]string{
+		"X-Forwarded-For": "no-ip",
+	}), config)
+	assert.NotNil(t, err)
+
+	ip, err = extractRemoteAddr(buildHTTPRequest("10.0.0.1:1234", map[string]string{
+		"X-Real-IP": "2001:db8::2",
+	}), config)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::2", ip)
+
+	ip, err = extractRemoteAddr(buildHTTPRequest("10.0.0.1:1234", map[string]string{
+		"Forwarded":       `for=9.9.9.9, for="[2001:db8::3]:4711";proto=https, for=10.0.0.2:80`,
+		"X-Forwarded-For": "5.6.7.8",
+	}), config)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::3", ip)
+
+	// unknown and obfuscated hops end the chain at the last known hop
+	ip, err = extractRemoteAddr(buildHTTPRequest("10.0.0.1:1234", map[string]string{
+		"Forwarded": "for=unknown",
+	}), config)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", ip)
+
+	ip, err = extractRemoteAddr(buildHTTPRequest("10.0.0.1:1234", map[string]string{
+		"Forwarded": `for=5.6.7.8, for="_hidden:_port", for=10.0.0.2`,
+	}), config)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.2", ip)
+
+	ip, err = extractRemoteAddr(buildHTTPRequest("10.0.0.1:1234", map[string]string{
+		"Forwarded": "for=UNKNOWN, for=5.6.7.8",
+	}), config)
+	assert.Nil(t, err)
+	assert.Equal(t, "5.6.7.8", ip)
+
+	ip, err = extractRemoteAddr(buildHTTPRequest("10.0.0.1:1234", map[string]string{
+		"Forwarded": "for=no-ip",
+	}), config)
+	assert.NotNil(t, err)
+}
+
+func TestUpdateKeepsCNAME(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	code, _ := serveJSON(t, f, "GET", "/update/pi/secret?cname=lb.example.net")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "lb.example.net", hosts.host(t, "pi").CNAME)
+
+	// the keep-alive update without parameters only renews the alias
+	code, result := serveJSON(t, f, "GET", "/update/pi/secret")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "lb.example.net", result["cname"])
+	assert.Equal(t, "", result["ipv4"])
+	assert.Equal(t, []interface{}{}, result["changed"])
+
+	host := hosts.host(t, "pi")
+	assert.Equal(t, "lb.example.net", host.CNAME)
+	assert.Empty(t, host.IPv4)
+
+	code, _ = serveJSON(t, f, "GET", "/update/pi/secret?ttl=60")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "lb.example.net", hosts.host(t, "pi").CNAME)
+
+	// explicit addresses turn the alias back into a host with addresses
+	code, result = serveJSON(t, f, "GET", "/update/pi/secret?ip=auto")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "192.0.2.1", result["ipv4"])
+	assert.Equal(t, []interface{}{"ipv4", "cname"}, result["changed"])
+	assert.Equal(t, "", hosts.host(t, "pi").CNAME)
+
+	code, _ = serveJSON(t, f, "GET", "/update/pi/secret?cname=lb.example.net&ipv4=10.0.0.2")
+	assert.Equal(t, 400, code)
+}
+
+func TestUpdateAddresses(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	// the sender address is used without parameters
+	code, result := serveJSON(t, f, "GET", "/update/pi/secret")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "192.0.2.1", result["ipv4"])
+	assert.Equal(t, "2001:db8::1", result["ipv6"])
+	assert.Equal(t, []interface{}{"ipv4"}, result["changed"])
+
+	_, result = serveJSON(t, f, "GET", "/update/pi/secret?ip=auto")
+	assert.Equal(t, []interface{}{}, result["changed"])
+
+	// `ip` sets the addresses of their families
+	_, result = serveJSON(t, f, "GET", "/update/pi/secret?ip=10.0.0.2,2001:db8::2")
+	assert.Equal(t, "10.0.0.2", result["ipv4"])
+	assert.Equal(t, "2001:db8::2", result["ipv6"])
+	assert.Equal(t, []interface{}{"ipv4", "ipv6"}, result["changed"])
+
+	_, result = serveJSON(t, f, "GET", "/update/pi/secret?ip=10.0.0.3,10.0.0.4")
+	assert.Equal(t, "10.0.0.3,10.0.0.4", result["ipv4"])
+	assert.Equal(t, "2001:db8::2", result["ipv6"])
+	assert.Equal(t, []interface{}{"ipv4"}, result["changed"])
+
+	// `ipv4` and `ipv6` set their family or clear it with `none`
+	_, result = serveJSON(t, f, "GET", "/update/pi/secret?ipv4=auto,10.0.0.5&ipv6=none")
+	assert.Equal(t, "192.0.2.1,10.0.0.5", result["ipv4"])
+	assert.Equal(t, "", result["ipv6"])
+	assert.Equal(t, []interface{}{"ipv4", "ipv6"}, result["changed"])
+
+	_, result = serveJSON(t, f, "GET", "/update/pi/secret?ipv6=2001:db8::3")
+	assert.Equal(t, "192.0.2.1,10.0.0.5", result["ipv4"])
+	assert.Equal(t, "2001:db8::3", result["ipv6"])
+	assert.Equal(t, []interface{}{"ipv6"}, result["changed"])
+
+	// addresses of the wrong family and invalid addresses leave the host alone
+	for _, query := range []string{"ipv4=2001:db8::4", "ipv6=10.0.0.6", "ipv6=auto", "ip=invalid", "ipv4=10.0.0.6,invalid"} {
+		code, result = serveJSON(t, f, "GET", "/update/pi/secret?"+query)
+		assert.Equal(t, 400, code, query)
+		assert.NotEmpty(t, result["error"], query)
+	}
+
+	host := hosts.host(t, "pi")
+	assert.Equal(t, shared.Addresses{"192.0.2.1", "10.0.0.5"}, host.IPv4)
+	assert.Equal(t, shared.Addresses{"2001:db8::3"}, host.IPv6)
+}
+
+func TestUpdateAddressesBehindProxy(t *testing.T) {
+	f, hosts := buildFrontend(t)
+	f.config.TrustedProxies = buildConfig("192.0.2.0/24").TrustedProxies
+
+	// `auto` refers to the address of the client behind a trusted proxy
+	recorder := serve(f, "GET", "/update/pi/secret?ipv6=auto", nil, map[string]string{"X-Forwarded-For": "2001:db8::5"})
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, shared.Addresses{"10.0.0.1"}, hosts.host(t, "pi").IPv4)
+	assert.Equal(t, shared.Addresses{"2001:db8::5"}, hosts.host(t, "pi").IPv6)
+}
+
+func TestDeleteHost(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	code, result := serveJSON(t, f, "DELETE", "/delete/pi/wrong")
+	assert.Equal(t, 403, code)
+	assert.NotEmpty(t, result["error"])
+	hosts.host(t, "pi")
+
+	code, _ = serveJSON(t, f, "DELETE", "/delete/notexisting/secret")
+	assert.Equal(t, 404, code)
+
+	code, _ = serveJSON(t, f, "DELETE", "/delete/in_valid/secret")
+	assert.Equal(t, 404, code)
+
+	hosts.unavailable = true
+	code, _ = serveJSON(t, f, "DELETE", "/delete/pi/secret")
+	assert.Equal(t, 503, code)
+	hosts.unavailable = false
+
+	code, result = serveJSON(t, f, "DELETE", "/delete/pi.example.org/secret")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "pi", result["hostname"])
+	assert.Equal(t, "example.org", result["zone"])
+
+	_, err := hosts.GetHost(context.Background(), "example.org", "pi")
+	assert.Equal(t, shared.ErrNotFound, err)
+
+	// the hostname can be registered again, which invalidates the old token
+	code, _ = serveJSON(t, f, "GET", "/new/pi")
+	assert.Equal(t, 200, code)
+
+	code, _ = serveJSON(t, f, "DELETE", "/delete/pi/secret")
+	assert.Equal(t, 403, code)
+}
+
+func TestNewHost(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	code, result := serveJSON(t, f, "GET", "/new/nas")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "nas", result["hostname"])
+
+	token := result["token"].(string)
+	assert.Equal(t, "/update/nas.example.org/"+token, result["update_link"])
+
+	code, _ = serveJSON(t, f, "GET", "/update/nas/"+token)
+	assert.Equal(t, 200, code)
+
+	// a registered hostname is not taken over, even by the same client
+	code, result = serveJSON(t, f, "GET", "/new/nas")
+	assert.Equal(t, 409, code)
+	assert.Equal(t, "This hostname has already been registered.", result["error"])
+
+	code, _ = serveJSON(t, f, "GET", "/update/nas/"+token)
+	assert.Equal(t, 200, code)
+
+	code, _ = serveJSON(t, f, "GET", "/new/in_valid")
+	assert.Equal(t, 404, code)
+
+	hosts.unavailable = true
+	code, _ = serveJSON(t, f, "GET", "/new/laptop")
+	assert.Equal(t, 503, code)
+}
+
+func TestTokenNew(t *testing.T) {
+	f, _ := buildFrontend(t)
+
+	code, result := serveJSON(t, f, "POST", "/token/new/pi/secret?name=router")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "router", result["name"])
+
+	token := result["token"].(string)
+	assert.True(t, strings.HasPrefix(token, "router."))
+	assert.Equal(t, "/update/pi.example.org/"+token, result["update_link"])
+
+	// both tokens are valid
+	code, result = serveJSON(t, f, "GET", "/token/list/pi/"+token)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []interface{}{"default", "router"}, result["tokens"])
+
+	code, _ = serveJSON(t, f, "GET", "/update/pi/secret")
+	assert.Equal(t, 200, code)
+
+	for _, name := range []string{"router", "default", "in valid", ""} {
+		code, result = serveJSON(t, f, "POST", "/token/new/pi/secret?name="+url.QueryEscape(name))
+		assert.Equal(t, 400, code, name)
+		assert.NotEmpty(t, result["error"], name)
+	}
+
+	code, _ = serveJSON(t, f, "POST", "/token/new/pi/wrong?name=laptop")
+	assert.Equal(t, 403, code)
+}
+
+func TestTokenNewLimit(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	for i := 1; i < shared.MaxTokens; i++ {
+		code, _ := serveJSON(t, f, "POST", fmt.Sprintf("/token/new/pi/secret?name=token%d", i))
+		assert.Equal(t, 200, code)
+	}
+
+	code, result := serveJSON(t, f, "POST", "/token/new/pi/secret?name=onemore")
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "Too many tokens", result["error"])
+	assert.Len(t, hosts.host(t, "pi").Tokens, shared.MaxTokens)
+}
+
+func TestTokenRotate(t *testing.T) {
+	f, _ := buildFrontend(t)
+
+	// the token used for the request is rotated by default
+	code, result := serveJSON(t, f, "POST", "/token/rotate/pi/secret")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "default", result["name"])
+	token := result["token"].(string)
+
+	code, _ = serveJSON(t, f, "GET", "/update/pi/secret")
+	assert.Equal(t, 403, code)
+
+	code, _ = serveJSON(t, f, "GET", "/update/pi/"+token)
+	assert.Equal(t, 200, code)
+
+	// other tokens are rotated by their name
+	_, result = serveJSON(t, f, "POST", "/token/new/pi/"+token+"?name=router")
+	router := result["token"].(string)
+
+	code, result = serveJSON(t, f, "POST", "/token/rotate/pi/"+token+"?name=router")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "router", result["name"])
+
+	code, _ = serveJSON(t, f, "GET", "/update/pi/"+router)
+	assert.Equal(t, 403, code)
+
+	code, _ = serveJSON(t, f, "GET", "/update/pi/"+result["token"].(string))
+	assert.Equal(t, 200, code)
+
+	code, _ = serveJSON(t, f, "POST", "/token/rotate/pi/"+token+"?name=laptop")
+	assert.Equal(t, 404, code)
+}
+
+func TestTokenRevoke(t *testing.T) {
+	f, _ := buildFrontend(t)
+
+	_, result := serveJSON(t, f, "POST", "/token/new/pi/secret?name=router")
+	router := result["token"].(string)
+
+	code, result := serveJSON(t, f, "POST", "/token/revoke/pi/secret?name=router")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []interface{}{"default"}, result["tokens"])
+
+	code, _ = serveJSON(t, f, "GET", "/update/pi/"+router)
+	assert.Equal(t, 403, code)
+
+	code, _ = serveJSON(t, f, "POST", "/token/revoke/pi/secret?name=router")
+	assert.Equal(t, 400, code)
+
+	// the last token cannot be revoked, because the host could not be managed anymore
+	code, result = serveJSON(t, f, "POST", "/token/revoke/pi/secret?name=default")
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "The last token of a host cannot be revoked", result["error"])
+
+	code, _ = serveJSON(t, f, "GET", "/update/pi/secret")
+	assert.Equal(t, 200, code)
+}
+
+func TestTokenRevokeDuringUpdates(t *testing.T) {
+	f, _ := buildFrontend(t)
+
+	_, result := serveJSON(t, f, "POST", "/token/new/pi/secret?name=router")
+	router := result["token"].(string)
+
+	// updates running while the token is revoked do not restore it
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			serve(f, "GET", fmt.Sprintf("/update/pi/secret?ipv4=10.0.1.%d", i), nil, nil)
+		}(i)
+	}
+
+	code, _ := serveJSON(t, f, "POST", "/token/revoke/pi/secret?name=router")
+	assert.Equal(t, 200, code)
+	wg.Wait()
+
+	code, _ = serveJSON(t, f, "GET", "/update/pi/"+router)
+	assert.Equal(t, 403, code)
+}
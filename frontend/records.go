@@ -0,0 +1,69 @@
+package frontend
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/pboehm/ddns/shared"
+)
+
+// recordsRequest replaces the MX and SRV records of a host, where omitted
+// lists are kept and empty lists remove all records of the type
+type recordsRequest struct {
+	MX  *shared.MXRecords  `json:"mx"`
+	SRV *shared.SRVRecords `json:"srv"`
+}
+
+// handleRecordsList returns the MX and SRV records of the host
+func (f *Frontend) handleRecordsList(c *gin.Context) {
+	host, _, ok := f.authenticateHost(c)
+	if !ok {
+		return
+	}
+
+	f.respondRecords(c, host)
+}
+
+// handleRecordsSet replaces the MX and SRV records of the host by the ones
+// passed as JSON
+func (f *Frontend) handleRecordsSet(c *gin.Context) {
+	var request recordsRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": "The request is not in the right format"})
+		return
+	}
+
+	host, ok := f.updateRequestedHost(c, "Could not update the records", func(host *shared.Host, _ string) error {
+		if request.MX != nil {
+			if err := host.SetMX(*request.MX); err != nil {
+				return err
+			}
+		}
+
+		if request.SRV != nil {
+			return host.SetSRV(*request.SRV)
+		}
+
+		return nil
+	})
+	if !ok {
+		return
+	}
+
+	f.respondRecords(c, host)
+}
+
+func (f *Frontend) respondRecords(c *gin.Context, host *shared.Host) {
+	mx, srv := host.MX, host.SRV
+	if mx == nil {
+		mx = shared.MXRecords{}
+	}
+	if srv == nil {
+		srv = shared.SRVRecords{}
+	}
+
+	c.JSON(200, gin.H{
+		"hostname": host.Hostname,
+		"zone":     host.Zone,
+		"mx":       mx,
+		"srv":      srv,
+	})
+}
@@ -0,0 +1,103 @@
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pboehm/ddns/shared"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// putRecords replaces the records of pi with the JSON body and returns the
+// status code and the decoded response
+func putRecords(t *testing.T, f *Frontend, body string) (int, map[string]interface{}) {
+	recorder := serve(f, "PUT", "/records/pi/secret", strings.NewReader(body), map[string]string{"Content-Type": "application/json"})
+
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%s: invalid JSON %q", body, recorder.Body.String())
+	}
+	return recorder.Code, result
+}
+
+func TestRecordsSet(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	code, result := putRecords(t, f, `{
+		"mx": [{"priority": 10, "target": "Mail.Example.org."}],
+		"srv": [{"service": "_SIP._tcp", "priority": 10, "weight": 5, "port": 5060, "target": "pi.example.org"}]
+	}`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "pi", result["hostname"])
+	assert.Len(t, result["mx"], 1)
+
+	host := hosts.host(t, "pi")
+	assert.Equal(t, shared.MXRecords{{Priority: 10, Target: "mail.example.org"}}, host.MX)
+	assert.Equal(t, shared.SRVRecords{{Service: "_sip._tcp", Priority: 10, Weight: 5, Port: 5060, Target: "pi.example.org"}}, host.SRV)
+
+	// omitted lists are kept and empty lists remove all records of the type
+	code, _ = putRecords(t, f, `{"mx": []}`)
+	assert.Equal(t, 200, code)
+
+	host = hosts.host(t, "pi")
+	assert.Empty(t, host.MX)
+	assert.Len(t, host.SRV, 1)
+
+	code, result = putRecords(t, f, `{}`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []interface{}{}, result["mx"])
+	assert.Len(t, result["srv"], 1)
+
+	code, _ = putRecords(t, f, `{"srv": []}`)
+	assert.Equal(t, 200, code)
+	assert.Empty(t, hosts.host(t, "pi").SRV)
+
+	// the records are listed with the token
+	code, result = serveJSON(t, f, "GET", "/records/pi/secret")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, []interface{}{}, result["srv"])
+}
+
+func TestRecordsSetInvalid(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	for _, body := range []string{
+		`{"srv": [{"service": "sip._tcp", "port": 5060, "target": "pi.example.org"}]}`,
+		`{"srv": [{"service": "_sip._http", "port": 5060, "target": "pi.example.org"}]}`,
+		`{"srv": [{"service": "_sip._tcp", "port": 0, "target": "pi.example.org"}]}`,
+		`{"srv": [{"service": "_sip._tcp", "port": 5060, "target": "pi"}]}`,
+		`{"mx": [{"priority": 10, "target": "mail"}]}`,
+		`{"mx": [{"priority": 10, "target": "mail.example.org"}], "srv": [{"service": "invalid"}]}`,
+		`{"mx": "mail.example.org"}`,
+	} {
+		code, result := putRecords(t, f, body)
+		assert.Equal(t, 400, code, body)
+		assert.NotEmpty(t, result["error"], body)
+	}
+
+	// invalid requests leave the host alone
+	host := hosts.host(t, "pi")
+	assert.Empty(t, host.MX)
+	assert.Empty(t, host.SRV)
+
+	recorder := serve(f, "PUT", "/records/pi/wrong", strings.NewReader(`{"mx": []}`), nil)
+	assert.Equal(t, 403, recorder.Code)
+}
+
+func TestRecordsSetOnCNAME(t *testing.T) {
+	f, hosts := buildFrontend(t)
+
+	host := hosts.host(t, "pi")
+	host.SetCNAME("lb.example.net")
+	hosts.SetHost(context.Background(), host)
+
+	// aliases cannot have MX records, but removing them is fine
+	code, result := putRecords(t, f, `{"mx": [{"priority": 10, "target": "mail.example.org"}]}`)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "A host with a CNAME cannot have MX records", result["error"])
+	assert.Empty(t, hosts.host(t, "pi").MX)
+
+	code, _ = putRecords(t, f, `{"mx": []}`)
+	assert.Equal(t, 200, code)
+}
@@ -127,7 +127,16 @@ const indexTemplate string = `
                     <div id="hostname_input" class="form-group">
                         <div class="input-group">
                             <input id="hostname" class="form-control input-lg" type="text" placeholder="my-own-hostname">
-                            <div class="input-group-addon input-lg">{{.domain}}</div>
+                            {{if eq (len .zones) 1}}
+                            <div class="input-group-addon input-lg">.{{index .zones 0}}</div>
+                            <input id="zone" type="hidden" value="{{index .zones 0}}">
+                            {{else}}
+                            <div class="input-group-btn">
+                                <select id="zone" class="form-control input-lg">
+                                    {{range .zones}}<option value="{{.}}">.{{.}}</option>{{end}}
+                                </select>
+                            </div>
+                            {{end}}
                         </div>
                     </div>
                 </form>
@@ -139,6 +148,25 @@ const indexTemplate string = `
 
             <div id="command_output"></div>
 
+            <div class="marketing">
+                <h4>Release a host</h4>
+
+                <p>A host that is no longer needed can be released using one of its tokens, so that the hostname
+                can be registered again.</p>
+
+                <form class="form-inline" role="form">
+                    <div class="form-group">
+                        <input id="release_hostname" class="form-control" type="text" placeholder="my-own-hostname.{{index .zones 0}}">
+                    </div>
+                    <div class="form-group">
+                        <input id="release_token" class="form-control" type="password" placeholder="token">
+                    </div>
+                    <input type="button" id="release" class="btn btn-danger" value="Release Host" />
+                </form>
+
+                <div id="release_output"></div>
+            </div>
+
         </div> <!-- /container -->
 
         <!-- jQuery (necessary for Bootstrap's JavaScript plugins) -->
@@ -163,8 +191,9 @@ const indexTemplate string = `
 
             function validate() {
                 var hostname = $('#hostname').val();
+                var zone = encodeURIComponent($('#zone').val());
 
-                $.getJSON("/available/" + hostname, function( data ) {
+                $.getJSON("/available/" + hostname + "?zone=" + zone, function( data ) {
                     if (data.available) {
                         isValid();
                     } else {
@@ -180,11 +209,14 @@ const indexTemplate string = `
                     timer = setTimeout(validate, 800)
                 });
 
+                $('#zone').on('change', validate);
+
 
                 $('#register').click(function() {
                     var hostname = $("#hostname").val();
+                    var zone = encodeURIComponent($('#zone').val());
 
-                    $.getJSON("/new/" + hostname, function( data ) {
+                    $.getJSON("/new/" + hostname + "?zone=" + zone, function( data ) {
                         console.log(data);
 
                         var host = location.protocol + '//' + location.host;
@@ -194,6 +226,32 @@ const indexTemplate string = `
                             data.update_link + "\"</pre>");
                     })
                 });
+
+                $('#release').click(function() {
+                    var hostname = $("#release_hostname").val();
+                    var token = $("#release_token").val();
+
+                    if (!hostname || !token) {
+                        return;
+                    }
+
+                    if (!confirm("Do you really want to release " + hostname + "? " +
+                                 "Its records are removed immediately and anyone can register it again.")) {
+                        return;
+                    }
+
+                    $.ajax({
+                        url: "/delete/" + encodeURIComponent(hostname) + "/" + encodeURIComponent(token),
+                        type: "DELETE",
+                        dataType: "json"
+                    }).done(function() {
+                        $("#release_output").html(
+                            "<p class=\"text-success\">The host has been released.</p>");
+                    }).fail(function(xhr) {
+                        var message = xhr.responseJSON ? xhr.responseJSON.error : "Could not release the host";
+                        $("#release_output").html($("<p class=\"text-danger\"></p>").text(message));
+                    });
+                });
             });
         </script>
     </body>
@@ -0,0 +1,94 @@
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/pboehm/ddns/shared"
+)
+
+// handleTokenList returns the names of the tokens of the host
+func (f *Frontend) handleTokenList(c *gin.Context) {
+	host, _, ok := f.authenticateHost(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"hostname": host.Hostname,
+		"zone":     host.Zone,
+		"tokens":   host.Tokens.Names(),
+	})
+}
+
+// handleTokenNew creates an additional token with the name passed via `name`
+func (f *Frontend) handleTokenNew(c *gin.Context) {
+	name := c.Query("name")
+
+	f.generateToken(c, func(host *shared.Host, _ string) (string, error) {
+		if _, exists := host.Tokens[name]; exists {
+			return "", errors.New("A token with this name exists already")
+		}
+
+		return name, nil
+	})
+}
+
+// handleTokenRotate replaces the token with the name passed via `name`, which
+// defaults to the token used for this request, by a new one
+func (f *Frontend) handleTokenRotate(c *gin.Context) {
+	f.generateToken(c, func(host *shared.Host, current string) (string, error) {
+		name := c.DefaultQuery("name", current)
+		if _, exists := host.Tokens[name]; !exists {
+			return "", &requestError{404, "A token with this name does not exist"}
+		}
+
+		return name, nil
+	})
+}
+
+// handleTokenRevoke removes the token with the name passed via `name`
+func (f *Frontend) handleTokenRevoke(c *gin.Context) {
+	host, ok := f.updateRequestedHost(c, "Could not revoke the token", func(host *shared.Host, _ string) error {
+		return host.RevokeToken(c.Query("name"))
+	})
+	if !ok {
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"hostname": host.Hostname,
+		"zone":     host.Zone,
+		"tokens":   host.Tokens.Names(),
+	})
+}
+
+// generateToken sets a new token with the name returned by tokenName, which
+// receives the host and the name of the token used for this request, and
+// returns it
+func (f *Frontend) generateToken(c *gin.Context, tokenName func(*shared.Host, string) (string, error)) {
+	var name, token string
+
+	host, ok := f.updateRequestedHost(c, "Could not store the token", func(host *shared.Host, current string) error {
+		var err error
+		if name, err = tokenName(host, current); err != nil {
+			return err
+		}
+
+		token, err = host.GenerateAndSetToken(name)
+		return err
+	})
+	if !ok {
+		return
+	}
+
+	fqdn := f.config.GetZone(host.Zone).Fqdn(host.Hostname)
+
+	c.JSON(200, gin.H{
+		"hostname":    host.Hostname,
+		"zone":        host.Zone,
+		"name":        name,
+		"token":       token,
+		"update_link": fmt.Sprintf("/update/%s/%s", fqdn, token),
+	})
+}
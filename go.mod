@@ -3,8 +3,13 @@ module github.com/pboehm/ddns
 go 1.12
 
 require (
+	github.com/alicebob/miniredis/v2 v2.11.0
 	github.com/garyburd/redigo v1.6.0
 	github.com/gin-gonic/gin v1.4.0
+	github.com/lib/pq v1.3.0
+	github.com/miekg/dns v1.1.25
 	github.com/stretchr/testify v1.3.0
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20190923035154-9ee001bba392
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58
 )
@@ -0,0 +1,106 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+)
+
+// MaxAddresses is the number of addresses of the same family a host can have,
+// which resolvers use in a round-robin fashion
+const MaxAddresses = 8
+
+// Addresses are the IPv4 or IPv6 addresses of a host
+type Addresses []string
+
+// String returns the addresses separated by comma
+func (a Addresses) String() string {
+	return strings.Join(a, ",")
+}
+
+// UnmarshalJSON also accepts the single address stored by previous versions
+func (a *Addresses) UnmarshalJSON(data []byte) error {
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		*a = splitAddresses(address)
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a Addresses) equal(other Addresses) bool {
+	if len(a) != len(other) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != other[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetIP makes the supplied address the only address of its family. The
+// addresses of the other family are kept while a CNAME is removed, as it
+// cannot coexist with other records.
+func (h *Host) SetIP(rawIp string) error {
+	return h.SetIPs([]string{rawIp})
+}
+
+// SetIPs replaces the addresses of the families of the supplied addresses, so
+// that a host can have multiple addresses of the same family. Families without
+// supplied addresses are kept.
+func (h *Host) SetIPs(rawIps []string) error {
+	ipv4, ipv6 := Addresses{}, Addresses{}
+
+	for _, rawIp := range rawIps {
+		ip := net.ParseIP(strings.TrimSpace(rawIp))
+		if ip == nil {
+			return errors.New("Invalid IP address")
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			ipv4 = ipv4.add(ip4.String())
+		} else {
+			ipv6 = ipv6.add(ip.String())
+		}
+	}
+
+	if len(ipv4) > MaxAddresses || len(ipv6) > MaxAddresses {
+		return errors.New("Too many IP addresses")
+	}
+
+	h.CNAME = ""
+
+	if len(ipv4) > 0 {
+		h.IPv4 = ipv4
+	}
+	if len(ipv6) > 0 {
+		h.IPv6 = ipv6
+	}
+
+	return nil
+}
+
+// add appends the address unless it exists already
+func (a Addresses) add(address string) Addresses {
+	for _, existing := range a {
+		if existing == address {
+			return a
+		}
+	}
+
+	return append(a, address)
+}
+
+func splitAddresses(value string) Addresses {
+	if value == "" {
+		return nil
+	}
+
+	return Addresses(strings.Split(value, ","))
+}
@@ -0,0 +1,422 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"go.etcd.io/bbolt"
+	"log"
+	"time"
+)
+
+// boltSweepInterval is the interval in which expired hosts are removed
+const boltSweepInterval = time.Minute
+
+var (
+	boltHostsBucket   = []byte("hosts")
+	boltSerialsBucket = []byte("serials")
+)
+
+// BoltBackend stores the hosts in an embedded single-file database, so that no
+// Redis server is needed for small installations. Every zone has a bucket
+// within the hosts bucket, which maps hostnames to JSON encoded records.
+type BoltBackend struct {
+	config *Config
+	db     *bbolt.DB
+	done   chan struct{}
+}
+
+// boltRecord is the stored form of a host including its expiration
+type boltRecord struct {
+	Host    *Host     `json:"host"`
+	Expires time.Time `json:"expires"`
+}
+
+func NewBoltBackend(config *Config) (*BoltBackend, error) {
+	db, err := bbolt.Open(config.BoltPath, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltSerialsBucket); err != nil {
+			return err
+		}
+
+		hosts, err := tx.CreateBucketIfNotExists(boltHostsBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, zone := range config.Zones {
+			if _, err := hosts.CreateBucketIfNotExists([]byte(zone.Name)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	b := &BoltBackend{config: config, db: db, done: make(chan struct{})}
+	go b.sweepPeriodically()
+
+	return b, nil
+}
+
+func (b *BoltBackend) Close() error {
+	close(b.done)
+	return b.db.Close()
+}
+
+// unavailable logs the error of the database and returns ErrUnavailable instead
+func (b *BoltBackend) unavailable(err error) error {
+	if b.config.Verbose {
+		log.Printf("Error while accessing the database: %v", err)
+	}
+
+	return ErrUnavailable
+}
+
+// zoneBucket returns the bucket holding the hosts of the zone
+func (b *BoltBackend) zoneBucket(tx *bbolt.Tx, zone string) *bbolt.Bucket {
+	return tx.Bucket(boltHostsBucket).Bucket([]byte(zone))
+}
+
+// getRecord returns the record of the host or nil if it does not exist or is
+// expired but has not been swept yet
+func (b *BoltBackend) getRecord(tx *bbolt.Tx, zone, name string, now time.Time) (*boltRecord, error) {
+	bucket := b.zoneBucket(tx, zone)
+	if bucket == nil {
+		return nil, nil
+	}
+
+	data := bucket.Get([]byte(name))
+	if data == nil {
+		return nil, nil
+	}
+
+	var record boltRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+
+	if !record.Expires.After(now) {
+		return nil, nil
+	}
+
+	record.Host.Zone, record.Host.Hostname = zone, name
+	record.Host.ExpiresAt = record.Expires
+	return &record, nil
+}
+
+func (b *BoltBackend) GetHost(ctx context.Context, zone, name string) (*Host, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, b.unavailable(err)
+	}
+
+	var record *boltRecord
+
+	err := b.db.View(func(tx *bbolt.Tx) (err error) {
+		record, err = b.getRecord(tx, zone, name, time.Now())
+		return err
+	})
+	if err != nil {
+		return nil, b.unavailable(err)
+	}
+
+	if record == nil {
+		return nil, ErrNotFound
+	}
+
+	return record.Host, nil
+}
+
+func (b *BoltBackend) ListHosts(ctx context.Context, zone, cursor string, count int) ([]*Host, string, error) {
+	// every page contains at least one host, so that listing makes progress
+	if count < 1 {
+		count = 1
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", b.unavailable(err)
+	}
+
+	hosts := []*Host{}
+	next := ""
+	now := time.Now()
+
+	// the cursor is the last hostname of the previous page
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := b.zoneBucket(tx, zone)
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+
+		key, _ := c.First()
+		if cursor != "" {
+			if key, _ = c.Seek([]byte(cursor)); key != nil && bytes.Equal(key, []byte(cursor)) {
+				key, _ = c.Next()
+			}
+		}
+
+		for ; key != nil; key, _ = c.Next() {
+			if len(hosts) == count {
+				next = hosts[len(hosts)-1].Hostname
+				return nil
+			}
+
+			record, err := b.getRecord(tx, zone, string(key), now)
+			if err != nil || record == nil {
+				continue
+			}
+
+			hosts = append(hosts, record.Host)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, "", b.unavailable(err)
+	}
+
+	return hosts, next, nil
+}
+
+func (b *BoltBackend) CreateHost(ctx context.Context, host *Host) error {
+	return b.storeHost(ctx, host.Zone, host.Hostname, func(existing *Host) (*Host, error) {
+		if existing != nil {
+			return nil, ErrHostExists
+		}
+		return host, nil
+	})
+}
+
+func (b *BoltBackend) SetHost(ctx context.Context, host *Host) error {
+	return b.storeHost(ctx, host.Zone, host.Hostname, func(existing *Host) (*Host, error) {
+		if existing == nil {
+			return nil, ErrNotFound
+		}
+		return host, nil
+	})
+}
+
+func (b *BoltBackend) UpdateHost(ctx context.Context, zone, hostname string, update func(*Host) error) error {
+	return b.storeHost(ctx, zone, hostname, func(existing *Host) (*Host, error) {
+		if existing == nil {
+			return nil, ErrNotFound
+		}
+		return existing, update(existing)
+	})
+}
+
+// storeHost writes the host returned by prepare, which receives the stored
+// host or nil if there is none, and renews its expiration. Write transactions
+// are serialized by the database, so that hosts are reliably checked for
+// existence and concurrent updates are not lost.
+func (b *BoltBackend) storeHost(ctx context.Context, zoneName, hostname string, prepare func(existing *Host) (*Host, error)) error {
+	zone := b.config.GetZone(zoneName)
+	if zone == nil {
+		return errors.New("Zone does not exist")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return b.unavailable(err)
+	}
+
+	now := time.Now()
+	updatedAt := now.Truncate(time.Second)
+	expires := updatedAt.Add(time.Duration(zone.HostExpirationDays) * 24 * time.Hour)
+
+	var host *Host
+	var prepareErr error
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		// prepare may change the existing host, so that the records are
+		// compared with a separately decoded copy
+		var existing *Host
+		previous, err := b.getRecord(tx, zone.Name, hostname, now)
+		if err != nil {
+			return err
+		} else if previous != nil {
+			record, _ := b.getRecord(tx, zone.Name, hostname, now)
+			existing = record.Host
+		}
+
+		if host, prepareErr = prepare(existing); prepareErr != nil {
+			return prepareErr
+		}
+
+		updated := *host
+		updated.UpdatedAt = updatedAt
+
+		data, err := json.Marshal(&boltRecord{Host: &updated, Expires: expires})
+		if err != nil {
+			return err
+		}
+
+		if err = b.zoneBucket(tx, zone.Name).Put([]byte(hostname), data); err != nil {
+			return err
+		}
+
+		if previous == nil || !previous.Host.SameRecords(host) {
+			return b.incrementSerial(tx, zone.Name, now)
+		}
+
+		return nil
+	})
+
+	if prepareErr != nil {
+		return prepareErr
+	} else if err != nil {
+		return b.unavailable(err)
+	}
+
+	host.UpdatedAt, host.ExpiresAt = updatedAt, expires
+	return nil
+}
+
+func (b *BoltBackend) DeleteHost(ctx context.Context, zone, name string) error {
+	if err := ctx.Err(); err != nil {
+		return b.unavailable(err)
+	}
+
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		now := time.Now()
+
+		existing, err := b.getRecord(tx, zone, name, now)
+		if err != nil {
+			return err
+		}
+
+		if existing == nil {
+			return ErrNotFound
+		}
+
+		if err = b.zoneBucket(tx, zone).Delete([]byte(name)); err != nil {
+			return err
+		}
+
+		return b.incrementSerial(tx, zone, now)
+	})
+
+	if err == ErrNotFound {
+		return err
+	} else if err != nil {
+		return b.unavailable(err)
+	}
+
+	return nil
+}
+
+func (b *BoltBackend) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, b.unavailable(err)
+	}
+
+	var serial uint32
+
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		serial = b.serial(tx, zone)
+		return nil
+	})
+	if err != nil {
+		return 0, b.unavailable(err)
+	}
+
+	if serial != 0 {
+		return serial, nil
+	}
+
+	// the serial of a new zone is initialized with the first serial of the day
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		if serial = b.serial(tx, zone); serial == 0 {
+			return b.incrementSerial(tx, zone, time.Now())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, b.unavailable(err)
+	}
+
+	return b.GetSerial(ctx, zone)
+}
+
+// serial returns the stored serial of the zone, which is 0 if there is none
+func (b *BoltBackend) serial(tx *bbolt.Tx, zone string) uint32 {
+	data := tx.Bucket(boltSerialsBucket).Get([]byte(zone))
+	if len(data) != 4 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(data)
+}
+
+func (b *BoltBackend) incrementSerial(tx *bbolt.Tx, zone string, now time.Time) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, nextSerial(b.serial(tx, zone), now))
+
+	return tx.Bucket(boltSerialsBucket).Put([]byte(zone), data)
+}
+
+func (b *BoltBackend) sweepPeriodically() {
+	ticker := time.NewTicker(boltSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			if err := b.sweep(now); err != nil {
+				log.Printf("Error while removing expired hosts: %v", err)
+			}
+		}
+	}
+}
+
+// sweep removes the hosts that have expired and increments the serial of the
+// zones they belonged to
+func (b *BoltBackend) sweep(now time.Time) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		for _, zone := range b.config.Zones {
+			bucket := b.zoneBucket(tx, zone.Name)
+			if bucket == nil {
+				continue
+			}
+
+			expired := [][]byte{}
+			err := bucket.ForEach(func(key, data []byte) error {
+				var record boltRecord
+				if err := json.Unmarshal(data, &record); err != nil || !record.Expires.After(now) {
+					expired = append(expired, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, key := range expired {
+				if err = bucket.Delete(key); err != nil {
+					return err
+				}
+			}
+
+			if len(expired) > 0 {
+				if err = b.incrementSerial(tx, zone.Name, now); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,65 @@
+package shared
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func buildBoltBackend(t *testing.T) (*BoltBackend, func()) {
+	dir, err := ioutil.TempDir("", "ddns-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		BoltPath: filepath.Join(dir, "ddns.db"),
+		Zones: []*Zone{
+			{Name: "example.org", SOAFqdn: "ns.example.org", HostExpirationDays: 10},
+			{Name: "iot.example.org", SOAFqdn: "ns.example.org", HostExpirationDays: 1},
+		},
+	}
+
+	backend, err := NewBoltBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return backend, func() {
+		backend.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) (Storage, func()) {
+		return buildBoltBackend(t)
+	})
+}
+
+func TestBoltExpiration(t *testing.T) {
+	backend, cleanup := buildBoltBackend(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	assert.Nil(t, backend.CreateHost(ctx, &Host{Zone: "example.org", Hostname: "pi"}))
+	assert.Nil(t, backend.CreateHost(ctx, &Host{Zone: "iot.example.org", Hostname: "pi"}))
+
+	serial, _ := backend.GetSerial(ctx, "iot.example.org")
+
+	// hosts of iot.example.org expire after one day
+	assert.Nil(t, backend.sweep(time.Now().Add(36*time.Hour)))
+
+	_, err := backend.GetHost(ctx, "iot.example.org", "pi")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = backend.GetHost(ctx, "example.org", "pi")
+	assert.Nil(t, err)
+
+	next, _ := backend.GetSerial(ctx, "iot.example.org")
+	assert.True(t, next > serial)
+}
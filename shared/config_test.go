@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseZone(t *testing.T) {
+	config := &Config{SOAFqdn: "ns.example.net", HostExpirationDays: 10}
+
+	zone, err := config.parseZone("D.Example.org.")
+	assert.Nil(t, err)
+	assert.Equal(t, "d.example.org", zone.Name)
+	assert.Equal(t, "hostmaster.d.example.org", zone.Hostmaster)
+	assert.Equal(t, []string{"ns.example.net"}, zone.Nameservers)
+	assert.Empty(t, zone.ApexIPv4)
+	assert.Empty(t, zone.ApexIPv6)
+
+	// the global nameservers and apex addresses are used by all zones
+	config.nameservers = "ns1.example.net, ns2.example.net."
+	config.apex = "192.0.2.1,2001:db8::1"
+
+	zone, err = config.parseZone("d.example.org,hostmaster=admin@example.net,expiration-days=30")
+	assert.Nil(t, err)
+	assert.Equal(t, "admin.example.net", zone.Hostmaster)
+	assert.Equal(t, 30, zone.HostExpirationDays)
+	assert.Equal(t, []string{"ns1.example.net", "ns2.example.net"}, zone.Nameservers)
+	assert.Equal(t, Addresses{"192.0.2.1"}, zone.ApexIPv4)
+	assert.Equal(t, Addresses{"2001:db8::1"}, zone.ApexIPv6)
+
+	// unless the zone has its own
+	zone, err = config.parseZone("iot.example.org,ns=ns.iot.example.org,ns=ns2.example.net,apex=192.0.2.2")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ns.iot.example.org", "ns2.example.net"}, zone.Nameservers)
+	assert.Equal(t, Addresses{"192.0.2.2"}, zone.ApexIPv4)
+	assert.Empty(t, zone.ApexIPv6)
+
+	for _, spec := range []string{
+		"",
+		"d.example.org,unknown=value",
+		"d.example.org,expiration-days=0",
+		"d.example.org,ns=invalid",
+		"d.example.org,apex=invalid",
+	} {
+		_, err = config.parseZone(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
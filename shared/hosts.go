@@ -1,36 +1,173 @@
 package shared
 
 import (
-	"crypto/sha1"
-	"fmt"
-	"strings"
+	"context"
+	"errors"
+	"regexp"
 	"time"
 )
 
+// MaxTXTRecords is the number of TXT values a host can hold at the same time,
+// which has to be at least two for issuing a certificate for the host and its
+// wildcard at once
+const MaxTXTRecords = 4
+
+var validTXTValue = regexp.MustCompile("^[a-zA-Z0-9_\\-=+/.]{1,255}$")
+
+// validFqdn matches lowercase FQDNs with at least two labels
+var validFqdn = regexp.MustCompile(`^([a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?\.)+[a-z][a-z0-9-]{0,61}[a-z0-9]$`)
+
+// TXTRecords are the values of the TXT records of a host, which are mainly used
+// for ACME DNS-01 challenges
+type TXTRecords []string
+
 type Host struct {
-	Hostname string `redis:"-"`
-	Ip       string `redis:"ip"`
-	Token    string `redis:"token"`
+	Zone     string     `redis:"-"`
+	Hostname string     `redis:"-"`
+	IPv4     Addresses  `redis:"ipv4"`
+	IPv6     Addresses  `redis:"ipv6"`
+	CNAME    string     `redis:"cname"`
+	Tokens   HostTokens `redis:"tokens"`
+	TXT      TXTRecords `redis:"txt"`
+	MX       MXRecords  `redis:"mx"`
+	SRV      SRVRecords `redis:"srv"`
+
+	// TTL is the TTL of the records of the host, where 0 means the default TTL
+	TTL int `redis:"ttl"`
+
+	// Wildcard makes the host answer queries for all names below it
+	Wildcard bool `redis:"wildcard"`
+
+	// UpdatedAt is the time of the last update and ExpiresAt the time when the
+	// host is released unless it is updated again, which are set by the backend
+	UpdatedAt time.Time `redis:"-"`
+	ExpiresAt time.Time `redis:"-" json:"-"`
+}
+
+// SetCNAME makes the host an alias of the supplied FQDN and removes its
+// addresses and MX records. The target is stored lowercase and without the trailing dot.
+func (h *Host) SetCNAME(target string) error {
+	target = normalizeFqdn(target)
+	if !isValidFqdn(target) {
+		return errors.New("Invalid CNAME target")
+	}
+
+	h.CNAME, h.IPv4, h.IPv6, h.MX = target, nil, nil, nil
+	return nil
 }
 
-func (h *Host) GenerateAndSetToken() {
-	hash := sha1.New()
-	hash.Write([]byte(fmt.Sprintf("%d", time.Now().UnixNano())))
-	hash.Write([]byte(h.Hostname))
+// AddTXT adds a TXT value to the host if it does not exist already
+func (h *Host) AddTXT(value string) error {
+	if !validTXTValue.MatchString(value) {
+		return errors.New("Invalid TXT value")
+	}
+
+	for _, existing := range h.TXT {
+		if existing == value {
+			return nil
+		}
+	}
+
+	if len(h.TXT) >= MaxTXTRecords {
+		return errors.New("Too many TXT values")
+	}
 
-	h.Token = fmt.Sprintf("%x", hash.Sum(nil))
+	h.TXT = append(h.TXT, value)
+	return nil
 }
 
-func (h *Host) IsIPv4() bool {
-	if strings.Contains(h.Ip, ".") {
-		return true
+// RemoveTXT removes a TXT value from the host
+func (h *Host) RemoveTXT(value string) {
+	remaining := TXTRecords{}
+	for _, existing := range h.TXT {
+		if existing != value {
+			remaining = append(remaining, existing)
+		}
 	}
 
-	return false
+	h.TXT = remaining
 }
 
+// SameRecords returns whether both hosts result in the same DNS records
+func (h *Host) SameRecords(other *Host) bool {
+	if !h.IPv4.equal(other.IPv4) || !h.IPv6.equal(other.IPv6) || h.CNAME != other.CNAME ||
+		h.TTL != other.TTL || h.Wildcard != other.Wildcard || len(h.TXT) != len(other.TXT) {
+		return false
+	}
+
+	for i := range h.TXT {
+		if h.TXT[i] != other.TXT[i] {
+			return false
+		}
+	}
+
+	return h.MX.equal(other.MX) && h.SRV.equal(other.SRV)
+}
+
+func isValidFqdn(name string) bool {
+	return len(name) <= 253 && validFqdn.MatchString(name)
+}
+
+// serialBase returns the first date-based serial (YYYYMMDDnn) of the day
+func serialBase(now time.Time) uint32 {
+	year, month, day := now.UTC().Date()
+	return uint32(year*1000000 + int(month)*10000 + day*100)
+}
+
+// nextSerial returns the serial following the supplied one, which is at least
+// the first date-based serial of the day
+func nextSerial(serial uint32, now time.Time) uint32 {
+	if base := serialBase(now); serial < base {
+		return base
+	}
+
+	return serial + 1
+}
+
+var (
+	// ErrNotFound is returned if the host has not been registered or expired
+	ErrNotFound = errors.New("Host does not exist")
+
+	// ErrHostExists is returned by CreateHost if the hostname is already taken
+	ErrHostExists = errors.New("Host exists already")
+
+	// ErrUnavailable is returned if the storage cannot be reached, so that it
+	// is unknown whether the host exists
+	ErrUnavailable = errors.New("Host storage is unavailable")
+)
+
+// HostBackend stores the hosts. Implementations return the errors above, so
+// that callers can tell a missing host from a failing storage.
 type HostBackend interface {
-	GetHost(string) (*Host, error)
+	GetHost(ctx context.Context, zone, hostname string) (*Host, error)
+
+	// CreateHost stores a new host and fails with ErrHostExists if the
+	// hostname has already been registered, even by a concurrent request.
+	CreateHost(ctx context.Context, host *Host) error
+
+	// SetHost updates a host and fails with ErrNotFound if it has been
+	// released or has expired since it was read, so that a stale update
+	// never registers a released host again.
+	SetHost(ctx context.Context, host *Host) error
+
+	// UpdateHost applies the update to the stored host and writes it within
+	// the same transaction, so that concurrent updates are not lost. The
+	// update may be called again with the current host when the host has been
+	// changed in the meantime. It fails with ErrNotFound if the host does not
+	// exist and with the error of the update if it fails.
+	UpdateHost(ctx context.Context, zone, hostname string, update func(*Host) error) error
+
+	// DeleteHost releases the host, so that its hostname can be registered
+	// again, and increments the serial of the zone.
+	DeleteHost(ctx context.Context, zone, hostname string) error
+
+	// ListHosts returns a page of the hosts registered in the zone starting at
+	// the supplied cursor (empty for the first page) and the cursor of the next
+	// page, which is empty if there are no more hosts. The page size is only a
+	// hint and a page may even be empty while there are more hosts.
+	ListHosts(ctx context.Context, zone, cursor string, count int) ([]*Host, string, error)
 
-	SetHost(*Host) error
+	// GetSerial returns the SOA serial of the zone, which is incremented by
+	// the backend whenever the records of a host change or a host expires.
+	GetSerial(ctx context.Context, zone string) (uint32, error)
 }
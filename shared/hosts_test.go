@@ -0,0 +1,183 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestTokenHandling(t *testing.T) {
+	host := &Host{Hostname: "pi"}
+
+	token, err := host.GenerateAndSetToken(DefaultTokenName)
+	assert.Nil(t, err)
+	assert.Len(t, token, len("default.")+64)
+	assert.True(t, strings.HasPrefix(token, "default."))
+	assert.NotContains(t, host.Tokens[DefaultTokenName], token[len("default."):])
+
+	name, ok := host.CheckToken(token)
+	assert.True(t, ok)
+	assert.Equal(t, DefaultTokenName, name)
+
+	_, ok = host.CheckToken(token[1:])
+	assert.False(t, ok)
+	_, ok = host.CheckToken("")
+	assert.False(t, ok)
+
+	otherToken, err := (&Host{Hostname: "pi"}).GenerateAndSetToken(DefaultTokenName)
+	assert.Nil(t, err)
+	assert.NotEqual(t, token, otherToken)
+}
+
+func TestNamedTokenHandling(t *testing.T) {
+	host := &Host{Hostname: "pi"}
+
+	defaultToken, err := host.GenerateAndSetToken(DefaultTokenName)
+	assert.Nil(t, err)
+	routerToken, err := host.GenerateAndSetToken("router")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"default", "router"}, host.Tokens.Names())
+
+	name, ok := host.CheckToken(routerToken)
+	assert.True(t, ok)
+	assert.Equal(t, "router", name)
+
+	// only the token named by the prefix is checked
+	secret := strings.TrimPrefix(routerToken, "router.")
+	_, ok = host.CheckToken("default." + secret)
+	assert.False(t, ok)
+	_, ok = host.CheckToken(secret)
+	assert.False(t, ok)
+	_, ok = host.CheckToken("unknown." + secret)
+	assert.False(t, ok)
+
+	// tokens without a prefix are default tokens issued before tokens had names
+	name, ok = host.CheckToken(strings.TrimPrefix(defaultToken, "default."))
+	assert.True(t, ok)
+	assert.Equal(t, DefaultTokenName, name)
+
+	_, err = host.GenerateAndSetToken("invalid name")
+	assert.NotNil(t, err)
+
+	// rotating a token invalidates the old one
+	rotatedToken, err := host.GenerateAndSetToken("router")
+	assert.Nil(t, err)
+	_, ok = host.CheckToken(routerToken)
+	assert.False(t, ok)
+	_, ok = host.CheckToken(rotatedToken)
+	assert.True(t, ok)
+
+	assert.Nil(t, host.RevokeToken("router"))
+	_, ok = host.CheckToken(rotatedToken)
+	assert.False(t, ok)
+	_, ok = host.CheckToken(defaultToken)
+	assert.True(t, ok)
+
+	assert.NotNil(t, host.RevokeToken("router"))
+	assert.NotNil(t, host.RevokeToken(DefaultTokenName))
+}
+
+func TestLegacyTokenMigration(t *testing.T) {
+	legacy := "3a1f5d0f0b7a4d3ec0d2a8d1c5b1f1e7d6c5b4a3"
+	host := &Host{Hostname: "pi", Tokens: HostTokens{DefaultTokenName: legacy}}
+
+	_, ok := host.CheckToken("wrong")
+	assert.False(t, ok)
+	assert.Equal(t, legacy, host.Tokens[DefaultTokenName])
+
+	// the plain text token is replaced by its hash after the first successful use
+	_, ok = host.CheckToken(legacy)
+	assert.True(t, ok)
+	assert.NotEqual(t, legacy, host.Tokens[DefaultTokenName])
+	_, ok = host.CheckToken(legacy)
+	assert.True(t, ok)
+
+	_, ok = (&Host{Hostname: "pi"}).CheckToken("")
+	assert.False(t, ok)
+}
+
+func TestCNAMEHandling(t *testing.T) {
+	host := &Host{IPv4: Addresses{"10.0.0.1"}, IPv6: Addresses{"2001:db8::1"}}
+
+	for _, target := range []string{"", "localhost", "-lb.example.net", "lb..example.net", "lb.example.123", "lb example.net"} {
+		assert.NotNil(t, host.SetCNAME(target), target)
+	}
+	assert.Equal(t, "", host.CNAME)
+
+	// a CNAME and addresses replace each other
+	assert.Nil(t, host.SetCNAME("LB-1.Cloud.example.net."))
+	assert.Equal(t, "lb-1.cloud.example.net", host.CNAME)
+	assert.Empty(t, host.IPv4)
+	assert.Empty(t, host.IPv6)
+
+	assert.Nil(t, host.SetIP("10.0.0.2"))
+	assert.Equal(t, "", host.CNAME)
+	assert.Equal(t, Addresses{"10.0.0.2"}, host.IPv4)
+
+	assert.False(t, host.SameRecords(&Host{CNAME: "lb-1.cloud.example.net"}))
+}
+
+func TestMXAndSRVHandling(t *testing.T) {
+	host := &Host{IPv4: Addresses{"10.0.0.1"}}
+
+	assert.Nil(t, host.SetMX(MXRecords{{Priority: 10, Target: "Mail.Example.org."}}))
+	assert.Equal(t, MXRecords{{Priority: 10, Target: "mail.example.org"}}, host.MX)
+
+	assert.NotNil(t, host.SetMX(MXRecords{{Priority: 10, Target: "mail"}}))
+	assert.NotNil(t, host.SetMX(MXRecords{{Target: "a.example.org"}, {Target: "a.example.org"}}))
+	assert.NotNil(t, host.SetMX(make(MXRecords, MaxMXRecords+1)))
+
+	assert.Nil(t, host.SetSRV(SRVRecords{{Service: "_SIP._udp", Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.org"}}))
+	assert.Equal(t, "_sip._udp", host.SRV[0].Service)
+
+	for _, record := range []SRVRecord{
+		{Service: "sip._udp", Port: 5060, Target: "sip.example.org"},
+		{Service: "_sip._foo", Port: 5060, Target: "sip.example.org"},
+		{Service: "_sip._udp", Port: 0, Target: "sip.example.org"},
+		{Service: "_sip._udp", Port: 5060, Target: "sip"},
+	} {
+		assert.NotNil(t, host.SetSRV(SRVRecords{record}), record.Service)
+	}
+	assert.Len(t, host.SRV, 1)
+
+	// a CNAME cannot coexist with MX records
+	assert.Nil(t, host.SetCNAME("lb.example.net"))
+	assert.Nil(t, host.MX)
+	assert.NotNil(t, host.SetMX(MXRecords{{Priority: 10, Target: "mail.example.org"}}))
+	assert.Nil(t, host.SetMX(MXRecords{}))
+	assert.True(t, host.SameRecords(&Host{CNAME: "lb.example.net", SRV: host.SRV}))
+}
+
+func TestMultipleAddresses(t *testing.T) {
+	host := &Host{IPv6: Addresses{"2001:db8::1"}}
+
+	// addresses replace the ones of their family only
+	assert.Nil(t, host.SetIPs([]string{"10.0.0.1", "10.0.0.2", "10.0.0.1"}))
+	assert.Equal(t, Addresses{"10.0.0.1", "10.0.0.2"}, host.IPv4)
+	assert.Equal(t, Addresses{"2001:db8::1"}, host.IPv6)
+	assert.Equal(t, "10.0.0.1,10.0.0.2", host.IPv4.String())
+
+	assert.Nil(t, host.SetIP("10.0.0.3"))
+	assert.Equal(t, Addresses{"10.0.0.3"}, host.IPv4)
+
+	tooMany := []string{}
+	for i := 0; i <= MaxAddresses; i++ {
+		tooMany = append(tooMany, fmt.Sprintf("10.0.1.%d", i))
+	}
+	assert.NotNil(t, host.SetIPs(tooMany))
+	assert.NotNil(t, host.SetIPs([]string{"10.0.0.4", "invalid"}))
+	assert.Equal(t, Addresses{"10.0.0.3"}, host.IPv4)
+
+	assert.False(t, host.SameRecords(&Host{IPv4: Addresses{"10.0.0.3", "10.0.0.4"}, IPv6: host.IPv6}))
+
+	// hosts stored as JSON by previous versions have a single address
+	var stored Host
+	assert.Nil(t, json.Unmarshal([]byte(`{"IPv4":"10.0.0.1","IPv6":""}`), &stored))
+	assert.Equal(t, Addresses{"10.0.0.1"}, stored.IPv4)
+	assert.Empty(t, stored.IPv6)
+
+	assert.Nil(t, json.Unmarshal([]byte(`{"IPv4":["10.0.0.1","10.0.0.2"]}`), &stored))
+	assert.Equal(t, Addresses{"10.0.0.1", "10.0.0.2"}, stored.IPv4)
+}
@@ -0,0 +1,414 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	_ "github.com/lib/pq"
+	"log"
+	"time"
+)
+
+// postgresCleanupInterval is the interval in which expired hosts are removed
+const postgresCleanupInterval = time.Minute
+
+// postgresMigrationLock is the key of the advisory lock that prevents multiple
+// instances from migrating the schema at the same time
+const postgresMigrationLock = 0x64646e73
+
+// postgresMigrations are the changes of the schema in the order they have to
+// be applied. Existing migrations must never be changed.
+var postgresMigrations = []string{
+	`CREATE TABLE ddns_hosts (
+		zone       TEXT        NOT NULL,
+		hostname   TEXT        NOT NULL,
+		data       JSONB       NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (zone, hostname)
+	);
+	CREATE INDEX ddns_hosts_expires_at ON ddns_hosts (expires_at);
+	CREATE TABLE ddns_serials (
+		zone   TEXT   PRIMARY KEY,
+		serial BIGINT NOT NULL
+	);`,
+}
+
+// PostgresBackend stores the hosts in PostgreSQL, so that multiple instances
+// can share them. The records of a host are stored as JSON, hosts are unique
+// per zone and expired hosts are removed periodically by every instance.
+type PostgresBackend struct {
+	config *Config
+	db     *sql.DB
+	done   chan struct{}
+}
+
+func NewPostgresBackend(config *Config) (*PostgresBackend, error) {
+	db, err := sql.Open("postgres", config.PostgresURL)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PostgresBackend{config: config, db: db, done: make(chan struct{})}
+
+	if err = p.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	go p.cleanupPeriodically()
+
+	return p, nil
+}
+
+func (p *PostgresBackend) Close() error {
+	close(p.done)
+	return p.db.Close()
+}
+
+// migrate applies the migrations that have not been applied yet
+func (p *PostgresBackend) migrate() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`CREATE TABLE IF NOT EXISTS ddns_schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM ddns_schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(postgresMigrations); version++ {
+		if _, err = tx.Exec(postgresMigrations[version]); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(`INSERT INTO ddns_schema_migrations (version) VALUES ($1)`, version+1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// unavailable logs the error of the database and returns ErrUnavailable instead
+func (p *PostgresBackend) unavailable(err error) error {
+	if p.config.Verbose {
+		log.Printf("Error while accessing PostgreSQL: %v", err)
+	}
+
+	return ErrUnavailable
+}
+
+// scanHost builds the host out of its JSON encoded data
+func (p *PostgresBackend) scanHost(zone, name string, data []byte, expires time.Time) (*Host, error) {
+	host := &Host{}
+	if err := json.Unmarshal(data, host); err != nil {
+		return nil, err
+	}
+
+	host.Zone, host.Hostname, host.ExpiresAt = zone, name, expires
+	return host, nil
+}
+
+func (p *PostgresBackend) GetHost(ctx context.Context, zone, name string) (*Host, error) {
+	var data []byte
+	var expires time.Time
+
+	err := p.db.QueryRowContext(ctx,
+		`SELECT data, expires_at FROM ddns_hosts WHERE zone = $1 AND hostname = $2 AND expires_at > now()`,
+		zone, name).Scan(&data, &expires)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, p.unavailable(err)
+	}
+
+	return p.scanHost(zone, name, data, expires)
+}
+
+// ListHosts uses the last hostname of the previous page as cursor
+func (p *PostgresBackend) ListHosts(ctx context.Context, zone, cursor string, count int) ([]*Host, string, error) {
+	// every page contains at least one host, so that listing makes progress
+	if count < 1 {
+		count = 1
+	}
+
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT hostname, data, expires_at FROM ddns_hosts
+		 WHERE zone = $1 AND hostname > $2 AND expires_at > now()
+		 ORDER BY hostname LIMIT $3`,
+		zone, cursor, count+1)
+	if err != nil {
+		return nil, "", p.unavailable(err)
+	}
+	defer rows.Close()
+
+	hosts := []*Host{}
+	for rows.Next() {
+		var name string
+		var data []byte
+		var expires time.Time
+
+		if err = rows.Scan(&name, &data, &expires); err != nil {
+			return nil, "", p.unavailable(err)
+		}
+
+		if host, err := p.scanHost(zone, name, data, expires); err == nil {
+			hosts = append(hosts, host)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, "", p.unavailable(err)
+	}
+
+	// one more host than requested is fetched to know whether there are more
+	next := ""
+	if len(hosts) > count {
+		hosts = hosts[:count]
+		next = hosts[count-1].Hostname
+	}
+
+	return hosts, next, nil
+}
+
+func (p *PostgresBackend) CreateHost(ctx context.Context, host *Host) error {
+	return p.storeHost(ctx, host.Zone, host.Hostname, func(existing *Host) (*Host, error) {
+		if existing != nil {
+			return nil, ErrHostExists
+		}
+		return host, nil
+	})
+}
+
+func (p *PostgresBackend) SetHost(ctx context.Context, host *Host) error {
+	return p.storeHost(ctx, host.Zone, host.Hostname, func(existing *Host) (*Host, error) {
+		if existing == nil {
+			return nil, ErrNotFound
+		}
+		return host, nil
+	})
+}
+
+func (p *PostgresBackend) UpdateHost(ctx context.Context, zone, hostname string, update func(*Host) error) error {
+	return p.storeHost(ctx, zone, hostname, func(existing *Host) (*Host, error) {
+		if existing == nil {
+			return nil, ErrNotFound
+		}
+		return existing, update(existing)
+	})
+}
+
+// storeHost writes the host returned by prepare, which receives the stored
+// host or nil if there is none, and renews its expiration. The stored host is
+// locked until the transaction ends, so that concurrent updates are not lost.
+// New hosts are inserted unless a host that is not expired exists, which is
+// decided atomically by the database based on the primary key.
+func (p *PostgresBackend) storeHost(ctx context.Context, zoneName, hostname string, prepare func(existing *Host) (*Host, error)) error {
+	zone := p.config.GetZone(zoneName)
+	if zone == nil {
+		return errors.New("Zone does not exist")
+	}
+
+	updatedAt := time.Now().Truncate(time.Second)
+	expiresAt := updatedAt.Add(time.Duration(zone.HostExpirationDays) * 24 * time.Hour)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return p.unavailable(err)
+	}
+	defer tx.Rollback()
+
+	var stored []byte
+	var expires time.Time
+
+	err = tx.QueryRowContext(ctx,
+		`SELECT data, expires_at FROM ddns_hosts WHERE zone = $1 AND hostname = $2 AND expires_at > now() FOR UPDATE`,
+		zone.Name, hostname).Scan(&stored, &expires)
+
+	// prepare may change the existing host, so that the records are compared
+	// with a separately decoded copy
+	var existing, previous *Host
+	if err == nil {
+		if existing, err = p.scanHost(zone.Name, hostname, stored, expires); err != nil {
+			return err
+		}
+		previous, _ = p.scanHost(zone.Name, hostname, stored, expires)
+	} else if err != sql.ErrNoRows {
+		return p.unavailable(err)
+	}
+
+	host, err := prepare(existing)
+	if err != nil {
+		return err
+	}
+
+	updated := *host
+	updated.UpdatedAt = updatedAt
+
+	data, err := json.Marshal(&updated)
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		// the insert is skipped when a concurrent registration has been
+		// committed in the meantime
+		err = tx.QueryRowContext(ctx,
+			`INSERT INTO ddns_hosts (zone, hostname, data, expires_at)
+			 VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (zone, hostname) DO UPDATE
+			 SET data = EXCLUDED.data, expires_at = EXCLUDED.expires_at
+			 WHERE ddns_hosts.expires_at <= now()
+			 RETURNING expires_at`,
+			zone.Name, hostname, data, expiresAt).Scan(&expires)
+
+		if err == sql.ErrNoRows {
+			return ErrHostExists
+		}
+	} else {
+		_, err = tx.ExecContext(ctx,
+			`UPDATE ddns_hosts SET data = $3, expires_at = $4 WHERE zone = $1 AND hostname = $2`,
+			zone.Name, hostname, data, expiresAt)
+	}
+
+	if err != nil {
+		return p.unavailable(err)
+	}
+
+	if previous == nil || !previous.SameRecords(host) {
+		if err = p.incrementSerial(ctx, tx, zone.Name); err != nil {
+			return p.unavailable(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return p.unavailable(err)
+	}
+
+	host.UpdatedAt, host.ExpiresAt = updatedAt, expiresAt
+	return nil
+}
+
+func (p *PostgresBackend) DeleteHost(ctx context.Context, zone, name string) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return p.unavailable(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		`DELETE FROM ddns_hosts WHERE zone = $1 AND hostname = $2 AND expires_at > now()`, zone, name)
+	if err != nil {
+		return p.unavailable(err)
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return p.unavailable(err)
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+
+	if err = p.incrementSerial(ctx, tx, zone); err != nil {
+		return p.unavailable(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return p.unavailable(err)
+	}
+
+	return nil
+}
+
+func (p *PostgresBackend) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	// the serial of a new zone is initialized with the first serial of the day
+	_, err := p.db.ExecContext(ctx,
+		`INSERT INTO ddns_serials (zone, serial) VALUES ($1, $2) ON CONFLICT (zone) DO NOTHING`,
+		zone, serialBase(time.Now()))
+	if err != nil {
+		return 0, p.unavailable(err)
+	}
+
+	var serial int64
+	if err = p.db.QueryRowContext(ctx, `SELECT serial FROM ddns_serials WHERE zone = $1`, zone).Scan(&serial); err != nil {
+		return 0, p.unavailable(err)
+	}
+
+	return uint32(serial), nil
+}
+
+// incrementSerial increments the serial of the zone, which is at least the
+// first date-based serial of the day
+func (p *PostgresBackend) incrementSerial(ctx context.Context, tx *sql.Tx, zone string) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO ddns_serials (zone, serial) VALUES ($1, $2)
+		 ON CONFLICT (zone) DO UPDATE SET serial = GREATEST(ddns_serials.serial + 1, EXCLUDED.serial)`,
+		zone, serialBase(time.Now()))
+
+	return err
+}
+
+func (p *PostgresBackend) cleanupPeriodically() {
+	ticker := time.NewTicker(postgresCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			if err := p.cleanup(context.Background()); err != nil {
+				log.Printf("Error while removing expired hosts: %v", err)
+			}
+		}
+	}
+}
+
+// cleanup removes the hosts that have expired and increments the serial of the
+// zones they belonged to
+func (p *PostgresBackend) cleanup(ctx context.Context) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `DELETE FROM ddns_hosts WHERE expires_at <= now() RETURNING zone`)
+	if err != nil {
+		return err
+	}
+
+	zones := map[string]bool{}
+	for rows.Next() {
+		var zone string
+		if err = rows.Scan(&zone); err != nil {
+			rows.Close()
+			return err
+		}
+		zones[zone] = true
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for zone := range zones {
+		if err = p.incrementSerial(ctx, tx, zone); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,162 @@
+package shared
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// MaxMXRecords and MaxSRVRecords are the number of MX and SRV records a host
+// can hold at the same time
+const (
+	MaxMXRecords  = 4
+	MaxSRVRecords = 8
+)
+
+// validService matches the `_service._proto` labels of SRV records
+var validService = regexp.MustCompile(`^_[a-z0-9]([a-z0-9-]{0,13}[a-z0-9])?\._(tcp|udp|tls|sctp)$`)
+
+type MXRecord struct {
+	Priority uint16 `json:"priority"`
+	Target   string `json:"target"`
+}
+
+// MXRecords are the mail exchangers of a host
+type MXRecords []MXRecord
+
+type SRVRecord struct {
+	// Service is the `_service._proto` part of the name of the record, which
+	// is looked up as `_service._proto.<host>`
+	Service  string `json:"service"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target"`
+}
+
+// SRVRecords are the service locations below a host
+type SRVRecords []SRVRecord
+
+// SetMX replaces the MX records of the host. Targets are stored lowercase and
+// without the trailing dot, which may be the host itself.
+func (h *Host) SetMX(records MXRecords) error {
+	if h.CNAME != "" && len(records) > 0 {
+		return errors.New("A host with a CNAME cannot have MX records")
+	}
+
+	if len(records) > MaxMXRecords {
+		return errors.New("Too many MX records")
+	}
+
+	normalized := MXRecords{}
+	for _, record := range records {
+		record.Target = normalizeFqdn(record.Target)
+		if !isValidFqdn(record.Target) {
+			return errors.New("Invalid MX target")
+		}
+
+		for _, existing := range normalized {
+			if existing.Target == record.Target {
+				return errors.New("Duplicate MX target")
+			}
+		}
+
+		normalized = append(normalized, record)
+	}
+
+	h.MX = normalized
+	return nil
+}
+
+// SetSRV replaces the SRV records of the host
+func (h *Host) SetSRV(records SRVRecords) error {
+	if len(records) > MaxSRVRecords {
+		return errors.New("Too many SRV records")
+	}
+
+	normalized := SRVRecords{}
+	for _, record := range records {
+		record.Service = strings.ToLower(record.Service)
+		if !validService.MatchString(record.Service) {
+			return errors.New("Invalid SRV service, which has to look like _service._tcp")
+		}
+
+		if record.Port == 0 {
+			return errors.New("Invalid SRV port")
+		}
+
+		record.Target = normalizeFqdn(record.Target)
+		if !isValidFqdn(record.Target) {
+			return errors.New("Invalid SRV target")
+		}
+
+		for _, existing := range normalized {
+			if existing.Service == record.Service && existing.Target == record.Target && existing.Port == record.Port {
+				return errors.New("Duplicate SRV record")
+			}
+		}
+
+		normalized = append(normalized, record)
+	}
+
+	h.SRV = normalized
+	return nil
+}
+
+// Services returns the distinct services of the SRV records
+func (r SRVRecords) Services() []string {
+	services := []string{}
+	seen := map[string]bool{}
+	for _, record := range r {
+		if !seen[record.Service] {
+			seen[record.Service] = true
+			services = append(services, record.Service)
+		}
+	}
+
+	return services
+}
+
+// HasProto returns whether a service of the SRV records uses the protocol,
+// e.g. _udp for _sip._udp
+func (r SRVRecords) HasProto(proto string) bool {
+	for _, record := range r {
+		if strings.HasSuffix(record.Service, "."+proto) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r MXRecords) equal(other MXRecords) bool {
+	if len(r) != len(other) {
+		return false
+	}
+
+	for i := range r {
+		if r[i] != other[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r SRVRecords) equal(other SRVRecords) bool {
+	if len(r) != len(other) {
+		return false
+	}
+
+	for i := range r {
+		if r[i] != other[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func normalizeFqdn(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
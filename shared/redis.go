@@ -1,80 +1,690 @@
 package shared
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"github.com/garyburd/redigo/redis"
+	"log"
+	"net"
+	"strings"
 	"time"
 )
 
 type RedisBackend struct {
-	expirationSeconds int
-	pool              *redis.Pool
+	config *Config
+	pool   *redis.Pool
 }
 
 func NewRedisBackend(config *Config) *RedisBackend {
-	return &RedisBackend{
-		expirationSeconds: config.HostExpirationDays * 24 * 60 * 60,
-		pool: &redis.Pool{
-			MaxIdle:     3,
-			IdleTimeout: 240 * time.Second,
-
-			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", config.RedisHost)
-				if err != nil {
-					return nil, err
-				}
-				return c, err
-			},
+	r := &RedisBackend{config: config}
 
-			TestOnBorrow: func(c redis.Conn, t time.Time) error {
-				_, err := c.Do("PING")
-				return err
-			},
-		},
+	r.pool = &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+
+		Dial:         r.dial,
+		TestOnBorrow: r.testOnBorrow,
 	}
+
+	return r
 }
 
-func (r *RedisBackend) Close() {
-	r.pool.Close()
+// dial connects to Redis, which is the current master in Sentinel mode
+func (r *RedisBackend) dial() (redis.Conn, error) {
+	address := r.config.RedisHost
+
+	if r.config.RedisSentinelMaster != "" {
+		var err error
+		if address, err = r.sentinelMaster(); err != nil {
+			return nil, err
+		}
+	}
+
+	return redis.Dial("tcp", address,
+		redis.DialConnectTimeout(r.config.RedisConnectTimeout),
+		redis.DialReadTimeout(r.config.RedisReadTimeout),
+		redis.DialWriteTimeout(r.config.RedisWriteTimeout),
+		redis.DialPassword(r.config.RedisPassword),
+		redis.DialDatabase(r.config.RedisDB),
+		redis.DialUseTLS(r.config.RedisTLS))
 }
 
-func (r *RedisBackend) GetHost(name string) (*Host, error) {
-	conn := r.pool.Get()
+// sentinelMaster asks the Sentinels one after another for the address of the
+// master until one of them answers
+func (r *RedisBackend) sentinelMaster() (string, error) {
+	err := errors.New("No Sentinel has been configured")
+
+	for _, sentinel := range r.config.RedisSentinels {
+		var address string
+		if address, err = r.askSentinel(sentinel); err == nil {
+			return address, nil
+		}
+
+		if r.config.Verbose {
+			log.Printf("Sentinel %s could not be asked for the master: %v", sentinel, err)
+		}
+	}
+
+	return "", err
+}
+
+func (r *RedisBackend) askSentinel(sentinel string) (string, error) {
+	conn, err := redis.Dial("tcp", sentinel,
+		redis.DialConnectTimeout(r.config.RedisConnectTimeout),
+		redis.DialReadTimeout(r.config.RedisReadTimeout),
+		redis.DialWriteTimeout(r.config.RedisWriteTimeout),
+		redis.DialPassword(r.config.RedisSentinelPassword),
+		redis.DialUseTLS(r.config.RedisSentinelTLS))
+	if err != nil {
+		return "", err
+	}
 	defer conn.Close()
 
-	host := Host{Hostname: name}
+	master, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", r.config.RedisSentinelMaster))
+	if err != nil {
+		return "", err
+	}
 
-	var err error
-	var data []interface{}
+	if len(master) != 2 {
+		return "", errors.New("Unknown master " + r.config.RedisSentinelMaster)
+	}
+
+	return net.JoinHostPort(master[0], master[1]), nil
+}
 
-	if data, err = redis.Values(conn.Do("HGETALL", host.Hostname)); err != nil {
+// testOnBorrow checks idle connections before they are used. In Sentinel mode
+// connections to a former master are dropped, so that a failover is followed.
+func (r *RedisBackend) testOnBorrow(c redis.Conn, t time.Time) error {
+	if r.config.RedisSentinelMaster == "" {
+		_, err := c.Do("PING")
+		return err
+	}
+
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+
+	if len(role) == 0 {
+		return errors.New("Invalid reply of ROLE")
+	}
+
+	if kind, _ := redis.String(role[0], nil); kind != "master" {
+		return errors.New("Redis server is not the master anymore")
+	}
+
+	return nil
+}
+
+func (r *RedisBackend) Close() error {
+	return r.pool.Close()
+}
+
+// hostKey returns the Redis key of a host: ddns:host:d.example.org:pi
+func (r *RedisBackend) hostKey(zone, hostname string) string {
+	return r.config.RedisPrefix + "host:" + zone + ":" + hostname
+}
+
+// conn returns a connection of the pool, where errors are reported as
+// ErrUnavailable
+func (r *RedisBackend) conn(ctx context.Context) (redis.Conn, error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return nil, r.unavailable(err)
+	}
+
+	return conn, nil
+}
+
+// unavailable logs the error of Redis and returns ErrUnavailable instead
+func (r *RedisBackend) unavailable(err error) error {
+	if r.config.Verbose {
+		log.Printf("Error while talking to Redis: %v", err)
+	}
+
+	return ErrUnavailable
+}
+
+func (r *RedisBackend) GetHost(ctx context.Context, zone, name string) (*Host, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
+
+	var data []interface{}
+	var ttl int64
+
+	key := r.hostKey(zone, name)
+	conn.Send("MULTI")
+	conn.Send("HGETALL", key)
+	conn.Send("TTL", key)
+
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, r.unavailable(err)
+	}
+
+	if _, err = redis.Scan(reply, &data, &ttl); err != nil {
+		return nil, r.unavailable(err)
+	}
 
 	if len(data) == 0 {
-		return nil, errors.New("Host does not exist")
+		return nil, ErrNotFound
 	}
 
-	if err = redis.ScanStruct(data, &host); err != nil {
+	host, err := r.scanHost(zone, name, data)
+	if err != nil {
 		return nil, err
 	}
 
+	host.ExpiresAt = expiresAt(ttl)
+	return host, nil
+}
+
+// expiresAt returns the time when a key with the remaining TTL expires
+func expiresAt(ttl int64) time.Time {
+	if ttl < 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(time.Duration(ttl) * time.Second).Truncate(time.Second)
+}
+
+// scanHost builds the host out of the fields of its Redis hash
+func (r *RedisBackend) scanHost(zone, name string, data []interface{}) (*Host, error) {
+	host := Host{Zone: zone, Hostname: name}
+
+	if err := redis.ScanStruct(data, &host); err != nil {
+		return nil, err
+	}
+
+	// hosts stored before dual-stack support and named tokens were added have a
+	// single `ip` and `token` field
+	extra := struct {
+		Ip      string `redis:"ip"`
+		Token   string `redis:"token"`
+		Updated int64  `redis:"updated"`
+	}{}
+
+	if err := redis.ScanStruct(data, &extra); err == nil {
+		if len(host.IPv4) == 0 && len(host.IPv6) == 0 && extra.Ip != "" {
+			host.SetIP(extra.Ip)
+		}
+
+		if len(host.Tokens) == 0 && extra.Token != "" {
+			host.Tokens = HostTokens{DefaultTokenName: extra.Token}
+		}
+
+		if extra.Updated > 0 {
+			host.UpdatedAt = time.Unix(extra.Updated, 0)
+		}
+	}
+
 	return &host, nil
 }
 
-func (r *RedisBackend) SetHost(host *Host) error {
-	conn := r.pool.Get()
+func (r *RedisBackend) ListHosts(ctx context.Context, zone, cursor string, count int) ([]*Host, string, error) {
+	// SCAN needs a positive COUNT, which is only a hint, so that pages may
+	// even be empty while the cursor still refers to more hosts
+	if count < 1 {
+		count = 1
+	}
+
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, "", err
+	}
 	defer conn.Close()
 
-	var err error
+	if cursor == "" {
+		cursor = "0"
+	}
+
+	var reply []interface{}
+	var keys []string
+
+	pattern := r.hostKey(zone, "*")
+	if reply, err = redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", count)); err != nil {
+		return nil, "", r.unavailable(err)
+	}
+
+	if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+		return nil, "", r.unavailable(err)
+	}
+
+	if cursor == "0" {
+		cursor = ""
+	}
+
+	names := []string{}
+	for _, key := range keys {
+		names = append(names, strings.TrimPrefix(key, strings.TrimSuffix(pattern, "*")))
+	}
+
+	for _, name := range names {
+		conn.Send("HGETALL", r.hostKey(zone, name))
+		if err = conn.Send("TTL", r.hostKey(zone, name)); err != nil {
+			return nil, "", r.unavailable(err)
+		}
+	}
+
+	if err = conn.Flush(); err != nil {
+		return nil, "", r.unavailable(err)
+	}
+
+	hosts := []*Host{}
+	for _, name := range names {
+		data, dataErr := redis.Values(conn.Receive())
+		ttl, err := redis.Int64(conn.Receive())
+
+		if err != nil {
+			return nil, "", r.unavailable(err)
+		} else if _, isRedisError := dataErr.(redis.Error); isRedisError {
+			// keys that do not belong to us might have a different type
+			continue
+		} else if dataErr != nil {
+			return nil, "", r.unavailable(dataErr)
+		}
+
+		host, err := r.scanHost(zone, name, data)
+		if err != nil || len(host.Tokens) == 0 {
+			continue
+		}
+
+		host.ExpiresAt = expiresAt(ttl)
+		hosts = append(hosts, host)
+	}
+
+	return hosts, cursor, nil
+}
+
+func (r *RedisBackend) CreateHost(ctx context.Context, host *Host) error {
+	return r.storeHost(ctx, host.Zone, host.Hostname, func(existing *Host) (*Host, error) {
+		if existing != nil {
+			return nil, ErrHostExists
+		}
+		return host, nil
+	})
+}
 
-	if _, err = conn.Do("HMSET", redis.Args{}.Add(host.Hostname).AddFlat(host)...); err != nil {
+func (r *RedisBackend) SetHost(ctx context.Context, host *Host) error {
+	return r.storeHost(ctx, host.Zone, host.Hostname, func(existing *Host) (*Host, error) {
+		if existing == nil {
+			return nil, ErrNotFound
+		}
+		return host, nil
+	})
+}
+
+func (r *RedisBackend) UpdateHost(ctx context.Context, zone, hostname string, update func(*Host) error) error {
+	return r.storeHost(ctx, zone, hostname, func(existing *Host) (*Host, error) {
+		if existing == nil {
+			return nil, ErrNotFound
+		}
+		return existing, update(existing)
+	})
+}
+
+// storeHost writes the host returned by prepare, which receives the stored
+// host or nil if there is none, and renews its expiration. The stored host is
+// watched and prepare is called again when it has been changed concurrently,
+// so that the host is checked and written within the same transaction.
+func (r *RedisBackend) storeHost(ctx context.Context, zoneName, hostname string, prepare func(existing *Host) (*Host, error)) error {
+	zone := r.config.GetZone(zoneName)
+	if zone == nil {
+		return errors.New("Zone does not exist")
+	}
+
+	conn, err := r.conn(ctx)
+	if err != nil {
 		return err
 	}
+	defer conn.Close()
+
+	key := r.hostKey(zone.Name, hostname)
+	expiration := time.Duration(zone.HostExpirationDays) * 24 * time.Hour
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return r.unavailable(err)
+		}
+
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return r.unavailable(err)
+		}
+
+		data, err := redis.Values(conn.Do("HGETALL", key))
+		if err != nil {
+			return r.unavailable(err)
+		}
+
+		// prepare may change the existing host, which is therefore scanned
+		// twice to find out whether the records have changed
+		var existing, previous *Host
+		if len(data) > 0 {
+			existing, err = r.scanHost(zone.Name, hostname, data)
+			if err == nil {
+				previous, err = r.scanHost(zone.Name, hostname, data)
+			}
+			if err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+		}
+
+		host, err := prepare(existing)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		now := time.Now()
+
+		conn.Send("MULTI")
+		conn.Send("HMSET", redis.Args{}.Add(key).AddFlat(host).Add("updated", now.Unix())...)
+		conn.Send("HDEL", key, "ip", "token")
+		conn.Send("EXPIRE", key, int(expiration.Seconds()))
+		conn.Send("ZADD", r.expirationsKey(zone.Name), now.Add(expiration).Unix(), hostname)
+
+		if previous == nil || !previous.SameRecords(host) {
+			serialScript.Send(conn, r.serialKey(zone.Name), r.expirationsKey(zone.Name), serialBase(now), 0, 1)
+		}
+
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return r.unavailable(err)
+		}
+
+		// the transaction is aborted when the host was changed in the meantime
+		if reply != nil {
+			host.UpdatedAt = time.Unix(now.Unix(), 0)
+			host.ExpiresAt = host.UpdatedAt.Add(expiration)
+			return nil
+		}
+	}
+}
 
-	if _, err = conn.Do("EXPIRE", host.Hostname, r.expirationSeconds); err != nil {
+func (r *RedisBackend) DeleteHost(ctx context.Context, zone, name string) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
 		return err
 	}
+	defer conn.Close()
+
+	key := r.hostKey(zone, name)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return r.unavailable(err)
+		}
+
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return r.unavailable(err)
+		}
+
+		exists, err := redis.Bool(conn.Do("EXISTS", key))
+		if err != nil {
+			return r.unavailable(err)
+		}
+
+		if !exists {
+			conn.Do("UNWATCH")
+			return ErrNotFound
+		}
+
+		conn.Send("MULTI")
+		conn.Send("DEL", key)
+		conn.Send("ZREM", r.expirationsKey(zone), name)
+		serialScript.Send(conn, r.serialKey(zone), r.expirationsKey(zone), serialBase(time.Now()), 0, 1)
+
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return r.unavailable(err)
+		}
+
+		if reply != nil {
+			return nil
+		}
+	}
+}
+
+// serialScript increments the serial of a zone when the records have changed
+// (ARGV[3] == 1) or hosts have expired since the last call. The new serial is
+// at least the first date-based serial of the current day (ARGV[1]).
+var serialScript = redis.NewScript(2, `
+	local expired = redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[2])
+	local serial = tonumber(redis.call('GET', KEYS[1]) or '0')
+
+	if serial == 0 or expired > 0 or ARGV[3] == '1' then
+		local base = tonumber(ARGV[1])
+		if serial < base then
+			serial = base
+		else
+			serial = serial + 1
+		end
+
+		redis.call('SET', KEYS[1], serial)
+	end
+
+	return serial
+`)
+
+func (r *RedisBackend) GetSerial(ctx context.Context, zone string) (uint32, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	now := time.Now()
 
+	serial, err := redis.Int64(serialScript.Do(conn, r.serialKey(zone), r.expirationsKey(zone), serialBase(now), now.Unix(), 0))
+	if err != nil {
+		return 0, r.unavailable(err)
+	}
+
+	return uint32(serial), nil
+}
+
+// serialKey returns the key holding the SOA serial of the zone
+func (r *RedisBackend) serialKey(zone string) string {
+	return r.config.RedisPrefix + "serial:" + zone
+}
+
+// expirationsKey returns the key of the sorted set holding the time when the
+// hosts of the zone expire, so that the serial can be incremented afterwards
+func (r *RedisBackend) expirationsKey(zone string) string {
+	return r.config.RedisPrefix + "expirations:" + zone
+}
+
+// legacyHostKey returns the key of a host before keys have been prefixed.
+// Hosts of the default zone were stored under their bare hostname and all
+// other hosts under their FQDN.
+func (r *RedisBackend) legacyHostKey(zone, hostname string) string {
+	if zone == r.config.DefaultZone().Name {
+		return hostname
+	}
+
+	return hostname + "." + zone
+}
+
+// MigrateKeys renames the keys of hosts stored before keys have been prefixed
+// and returns the number of migrated hosts. Only hashes containing a token
+// are renamed, so that keys of other applications are left alone. Hosts that
+// exist under both keys keep the prefixed one.
+func (r *RedisBackend) MigrateKeys() (int, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	migrated := 0
+
+	for _, zone := range r.config.Zones {
+		pattern := r.legacyHostKey(zone.Name, "*")
+		cursor := "0"
+
+		for {
+			var keys []string
+
+			reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+			if err != nil {
+				return migrated, err
+			}
+
+			if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+				return migrated, err
+			}
+
+			for _, key := range keys {
+				// hostnames never contain dots or colons, which skips keys of
+				// other zones and of ddns itself
+				name := strings.TrimSuffix(key, strings.TrimPrefix(pattern, "*"))
+				if strings.ContainsAny(name, ".:") {
+					continue
+				}
+
+				ok, err := r.migrateKey(conn, zone.Name, name)
+				if err != nil {
+					return migrated, err
+				}
+
+				if ok {
+					migrated++
+				}
+			}
+
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+
+	return migrated, nil
+}
+
+// migrateKey renames the legacy key of a single host if it belongs to ddns
+func (r *RedisBackend) migrateKey(conn redis.Conn, zone, name string) (bool, error) {
+	key := r.legacyHostKey(zone, name)
+
+	if keyType, err := redis.String(conn.Do("TYPE", key)); err != nil || keyType != "hash" {
+		return false, err
+	}
+
+	hasToken, err := redis.Bool(conn.Do("HEXISTS", key, "token"))
+	if err != nil {
+		return false, err
+	}
+
+	hasTokens, err := redis.Bool(conn.Do("HEXISTS", key, "tokens"))
+	if err != nil {
+		return false, err
+	}
+
+	if !hasToken && !hasTokens {
+		return false, nil
+	}
+
+	renamed, err := redis.Bool(conn.Do("RENAMENX", key, r.hostKey(zone, name)))
+	if err != nil || !renamed {
+		return false, err
+	}
+
+	// hosts created before the serial was tracked are missing from the sorted
+	// set of expirations, so that their expiration is taken from the key
+	ttl, err := redis.Int64(conn.Do("TTL", r.hostKey(zone, name)))
+	if err != nil {
+		return true, err
+	}
+
+	if ttl > 0 {
+		expires := time.Now().Unix() + ttl
+		if _, err = conn.Do("ZADD", r.expirationsKey(zone), "NX", expires, name); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// RedisArg stores the TXT values as a JSON encoded list
+func (t TXTRecords) RedisArg() interface{} {
+	if t == nil {
+		return "[]"
+	}
+
+	return redisJSONArg([]string(t))
+}
+
+func (t *TXTRecords) RedisScan(src interface{}) error {
+	return redisJSONScan(src, (*[]string)(t))
+}
+
+// RedisArg stores the addresses separated by comma, which is compatible with
+// the single address stored by previous versions
+func (a Addresses) RedisArg() interface{} {
+	return a.String()
+}
+
+func (a *Addresses) RedisScan(src interface{}) error {
+	data, ok := src.([]byte)
+	if !ok {
+		return errors.New("Invalid addresses")
+	}
+
+	*a = splitAddresses(string(data))
 	return nil
 }
+
+// RedisArg stores the MX records as a JSON encoded list
+func (r MXRecords) RedisArg() interface{} {
+	if r == nil {
+		return "[]"
+	}
+
+	return redisJSONArg([]MXRecord(r))
+}
+
+func (r *MXRecords) RedisScan(src interface{}) error {
+	return redisJSONScan(src, (*[]MXRecord)(r))
+}
+
+// RedisArg stores the SRV records as a JSON encoded list
+func (r SRVRecords) RedisArg() interface{} {
+	if r == nil {
+		return "[]"
+	}
+
+	return redisJSONArg([]SRVRecord(r))
+}
+
+func (r *SRVRecords) RedisScan(src interface{}) error {
+	return redisJSONScan(src, (*[]SRVRecord)(r))
+}
+
+// RedisArg stores the tokens as a JSON encoded object
+func (t HostTokens) RedisArg() interface{} {
+	if t == nil {
+		return "{}"
+	}
+
+	return redisJSONArg(map[string]string(t))
+}
+
+func (t *HostTokens) RedisScan(src interface{}) error {
+	return redisJSONScan(src, (*map[string]string)(t))
+}
+
+func redisJSONArg(value interface{}) interface{} {
+	data, _ := json.Marshal(value)
+	return data
+}
+
+func redisJSONScan(src interface{}, value interface{}) error {
+	data, ok := src.([]byte)
+	if !ok {
+		return errors.New("Invalid JSON value")
+	}
+
+	return json.Unmarshal(data, value)
+}
@@ -0,0 +1,325 @@
+package shared
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func buildRedisBackend(t *testing.T) (*miniredis.Miniredis, *RedisBackend) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		RedisHost:   server.Addr(),
+		RedisPrefix: "ddns:",
+		Zones: []*Zone{
+			{Name: "example.org", SOAFqdn: "ns.example.org", HostExpirationDays: 10},
+			{Name: "iot.example.org", SOAFqdn: "ns.example.org", HostExpirationDays: 10},
+		},
+	}
+
+	return server, NewRedisBackend(config)
+}
+
+func TestRedisStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) (Storage, func()) {
+		server, backend := buildRedisBackend(t)
+		return backend, func() {
+			backend.Close()
+			server.Close()
+		}
+	})
+}
+
+func TestRedisExpiration(t *testing.T) {
+	server, backend := buildRedisBackend(t)
+	defer server.Close()
+	defer backend.Close()
+
+	ctx := context.Background()
+
+	host := &Host{Zone: "example.org", Hostname: "pi", IPv4: Addresses{"1.2.3.4"}}
+	assert.Nil(t, backend.CreateHost(ctx, host))
+	serial, _ := backend.GetSerial(ctx, "example.org")
+
+	// hosts expire by their key, which is recorded in the expirations of the zone
+	assert.True(t, server.TTL("ddns:host:example.org:pi") > 9*24*time.Hour)
+	expires, err := server.ZScore("ddns:expirations:example.org", "pi")
+	assert.Nil(t, err)
+	assert.InDelta(t, float64(host.ExpiresAt.Unix()), expires, 1)
+
+	server.Del("ddns:host:example.org:pi")
+	server.ZAdd("ddns:expirations:example.org", float64(time.Now().Unix()-1), "pi")
+
+	// the serial is incremented once after the host has expired
+	next, _ := backend.GetSerial(ctx, "example.org")
+	assert.Equal(t, serial+1, next)
+	next, _ = backend.GetSerial(ctx, "example.org")
+	assert.Equal(t, serial+1, next)
+
+	_, err = backend.GetHost(ctx, "example.org", "pi")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, backend.CreateHost(ctx, host))
+}
+
+func TestUnavailableRedis(t *testing.T) {
+	server, backend := buildRedisBackend(t)
+	defer backend.Close()
+
+	ctx := context.Background()
+	host := &Host{Zone: "example.org", Hostname: "pi"}
+
+	server.Close()
+
+	_, err := backend.GetHost(ctx, "example.org", "pi")
+	assert.Equal(t, ErrUnavailable, err)
+	assert.Equal(t, ErrUnavailable, backend.CreateHost(ctx, host))
+	assert.Equal(t, ErrUnavailable, backend.SetHost(ctx, host))
+	assert.Equal(t, ErrUnavailable, backend.DeleteHost(ctx, "example.org", "pi"))
+
+	_, _, err = backend.ListHosts(ctx, "example.org", "", 10)
+	assert.Equal(t, ErrUnavailable, err)
+
+	_, err = backend.GetSerial(ctx, "example.org")
+	assert.Equal(t, ErrUnavailable, err)
+}
+
+func TestMigrateKeys(t *testing.T) {
+	server, backend := buildRedisBackend(t)
+	defer server.Close()
+	defer backend.Close()
+
+	ctx := context.Background()
+
+	server.HSet("pi", "ip", "1.2.3.4")
+	server.HSet("pi", "token", "abc")
+	server.SetTTL("pi", 24*time.Hour)
+	server.HSet("pi.iot.example.org", "ipv6", "2001:db8::1")
+	server.HSet("pi.iot.example.org", "tokens", `{"default":"def"}`)
+
+	// keys of other applications are left alone
+	server.Set("cache", "value")
+	server.HSet("session", "user", "pi")
+
+	migrated, err := backend.MigrateKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, migrated)
+
+	host, err := backend.GetHost(ctx, "example.org", "pi")
+	assert.Nil(t, err)
+	assert.Equal(t, Addresses{"1.2.3.4"}, host.IPv4)
+	assert.True(t, server.TTL("ddns:host:example.org:pi") > 0)
+
+	host, err = backend.GetHost(ctx, "iot.example.org", "pi")
+	assert.Nil(t, err)
+	assert.Equal(t, Addresses{"2001:db8::1"}, host.IPv6)
+
+	assert.False(t, server.Exists("pi"))
+	assert.True(t, server.Exists("cache"))
+	assert.True(t, server.Exists("session"))
+
+	// the hosts of each zone are listed separately
+	hosts, _, err := backend.ListHosts(ctx, "example.org", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, hosts, 1)
+
+	migrated, err = backend.MigrateKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, migrated)
+}
+
+func TestRedisAuthenticationAndDatabase(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.RequireAuth("secret")
+
+	config := &Config{
+		RedisHost:   "redis://:secret@" + server.Addr() + "/2",
+		RedisPrefix: "ddns:",
+		Zones:       []*Zone{{Name: "example.org", SOAFqdn: "ns.example.org", HostExpirationDays: 10}},
+	}
+	config.validateRedis()
+
+	assert.Equal(t, server.Addr(), config.RedisHost)
+	assert.Equal(t, "secret", config.RedisPassword)
+	assert.Equal(t, 2, config.RedisDB)
+	assert.False(t, config.RedisTLS)
+
+	backend := NewRedisBackend(config)
+	defer backend.Close()
+
+	assert.Nil(t, backend.CreateHost(context.Background(), &Host{Zone: "example.org", Hostname: "pi"}))
+
+	server.Select(2)
+	assert.True(t, server.Exists("ddns:host:example.org:pi"))
+	server.Select(0)
+	assert.False(t, server.Exists("ddns:host:example.org:pi"))
+}
+
+// startFakeSentinel answers SENTINEL get-master-addr-by-name with the address
+// returned by master, after authenticating with the password if it is set
+func startFakeSentinel(t *testing.T, password string, master func() string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				authenticated := password == ""
+
+				for {
+					args, err := readCommand(reader)
+					if err != nil {
+						return
+					}
+
+					if len(args) == 2 && strings.ToUpper(args[0]) == "AUTH" {
+						if authenticated = args[1] == password; authenticated {
+							fmt.Fprint(conn, "+OK\r\n")
+						} else {
+							fmt.Fprint(conn, "-ERR invalid password\r\n")
+						}
+					} else if !authenticated {
+						fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+					} else if len(args) == 3 && strings.ToUpper(args[0]) == "SENTINEL" && args[2] == "ddns" {
+						host, port, _ := net.SplitHostPort(master())
+						fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+					} else {
+						fmt.Fprint(conn, "*-1\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return listener
+}
+
+// readCommand reads a command in the Redis protocol
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	count, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	args := make([]string, count)
+
+	for i := range args {
+		if _, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+
+		if args[i], err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSpace(args[i])
+	}
+
+	return args, nil
+}
+
+func TestRedisSentinelFailover(t *testing.T) {
+	first, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	var mutex sync.Mutex
+	master := first.Addr()
+
+	sentinel := startFakeSentinel(t, "", func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return master
+	})
+	defer sentinel.Close()
+
+	config := &Config{
+		RedisPrefix:         "ddns:",
+		RedisSentinelMaster: "ddns",
+		RedisSentinels:      []string{"127.0.0.1:1", sentinel.Addr().String()},
+		Zones:               []*Zone{{Name: "example.org", SOAFqdn: "ns.example.org", HostExpirationDays: 10}},
+	}
+
+	backend := NewRedisBackend(config)
+	defer backend.Close()
+
+	ctx := context.Background()
+
+	assert.Nil(t, backend.CreateHost(ctx, &Host{Zone: "example.org", Hostname: "pi"}))
+	assert.True(t, first.Exists("ddns:host:example.org:pi"))
+
+	// the Sentinels promote the second server
+	mutex.Lock()
+	master = second.Addr()
+	mutex.Unlock()
+	first.Close()
+
+	assert.Nil(t, backend.CreateHost(ctx, &Host{Zone: "example.org", Hostname: "pi"}))
+	assert.True(t, second.Exists("ddns:host:example.org:pi"))
+
+	config.RedisSentinelMaster = "unknown"
+	_, err = backend.sentinelMaster()
+	assert.NotNil(t, err)
+}
+
+func TestRedisSentinelAuthentication(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	sentinel := startFakeSentinel(t, "sentinel", server.Addr)
+	defer sentinel.Close()
+
+	config := &Config{
+		RedisPrefix:         "ddns:",
+		RedisSentinelMaster: "ddns",
+		RedisSentinels:      []string{sentinel.Addr().String()},
+		Zones:               []*Zone{{Name: "example.org", SOAFqdn: "ns.example.org", HostExpirationDays: 10}},
+	}
+
+	backend := NewRedisBackend(config)
+	defer backend.Close()
+
+	_, err = backend.sentinelMaster()
+	assert.NotNil(t, err)
+
+	config.RedisSentinelPassword = "sentinel"
+	address, err := backend.sentinelMaster()
+	assert.Nil(t, err)
+	assert.Equal(t, server.Addr(), address)
+}
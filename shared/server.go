@@ -0,0 +1,36 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout bounds the time spent on finishing the running requests
+// after the server has been stopped
+const shutdownTimeout = 5 * time.Second
+
+// ListenAndServe serves the HTTP handler on the address until the context is
+// canceled, which shuts the server down and returns nil
+func ListenAndServe(ctx context.Context, addr string, handler http.Handler) error {
+	server := &http.Server{Addr: addr, Handler: handler}
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		case <-stopped:
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListenAndServe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// an address in use is reported
+	assert.NotNil(t, ListenAndServe(context.Background(), listener.Addr().String(), http.NotFoundHandler()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- ListenAndServe(ctx, "127.0.0.1:0", http.NotFoundHandler())
+	}()
+
+	// canceling the context shuts the server down without an error
+	cancel()
+
+	select {
+	case err := <-result:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return")
+	}
+}
@@ -0,0 +1,23 @@
+package shared
+
+import (
+	"io"
+)
+
+// Storage is a HostBackend that has to be closed on shutdown
+type Storage interface {
+	HostBackend
+	io.Closer
+}
+
+// OpenStorage returns the host storage selected by --storage
+func OpenStorage(config *Config) (Storage, error) {
+	switch config.StorageType {
+	case "bolt":
+		return NewBoltBackend(config)
+	case "postgres":
+		return NewPostgresBackend(config)
+	default:
+		return NewRedisBackend(config), nil
+	}
+}
@@ -0,0 +1,263 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storageBuilder returns an empty storage for the zones example.org, whose
+// hosts expire after 10 days, and iot.example.org together with its cleanup
+type storageBuilder func(t *testing.T) (Storage, func())
+
+// testStorage runs the tests every storage has to pass
+func testStorage(t *testing.T, build storageBuilder) {
+	tests := []struct {
+		name string
+		test func(*testing.T, Storage)
+	}{
+		{"HostHandling", testStorageHostHandling},
+		{"StaleSetHost", testStorageStaleSetHost},
+		{"UpdateHost", testStorageUpdateHost},
+		{"ListHosts", testStorageListHosts},
+		{"Serial", testStorageSerial},
+		{"ConcurrentCreateHost", testStorageConcurrentCreateHost},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			storage, cleanup := build(t)
+			defer cleanup()
+
+			test.test(t, storage)
+		})
+	}
+}
+
+func testStorageHostHandling(t *testing.T, storage Storage) {
+	ctx := context.Background()
+
+	host := &Host{
+		Zone:     "example.org",
+		Hostname: "pi",
+		IPv4:     Addresses{"1.2.3.4", "5.6.7.8"},
+		Tokens:   HostTokens{DefaultTokenName: "abc"},
+		Wildcard: true,
+		MX:       MXRecords{{Priority: 10, Target: "pi.example.org"}},
+		SRV:      SRVRecords{{Service: "_sip._udp", Priority: 10, Weight: 5, Port: 5060, Target: "pi.example.org"}},
+	}
+	assert.Nil(t, storage.CreateHost(ctx, host))
+	assert.Equal(t, ErrHostExists, storage.CreateHost(ctx, &Host{Zone: "example.org", Hostname: "pi"}))
+
+	stored, err := storage.GetHost(ctx, "example.org", "pi")
+	assert.Nil(t, err)
+	assert.Equal(t, "example.org", stored.Zone)
+	assert.Equal(t, "pi", stored.Hostname)
+	assert.Equal(t, host.IPv4, stored.IPv4)
+	assert.Empty(t, stored.IPv6)
+	assert.Equal(t, host.Tokens, stored.Tokens)
+	assert.Equal(t, host.MX, stored.MX)
+	assert.Equal(t, host.SRV, stored.SRV)
+	assert.True(t, stored.Wildcard)
+	assert.True(t, host.UpdatedAt.Equal(stored.UpdatedAt))
+	assert.WithinDuration(t, time.Now(), stored.UpdatedAt, 2*time.Second)
+	assert.WithinDuration(t, stored.UpdatedAt.Add(10*24*time.Hour), stored.ExpiresAt, time.Second)
+
+	// hosts are unique per zone
+	_, err = storage.GetHost(ctx, "iot.example.org", "pi")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = storage.GetHost(ctx, "example.org", "notexisting")
+	assert.Equal(t, ErrNotFound, err)
+
+	host.IPv6 = Addresses{"2001:db8::1"}
+	assert.Nil(t, storage.SetHost(ctx, host))
+	stored, err = storage.GetHost(ctx, "example.org", "pi")
+	assert.Nil(t, err)
+	assert.Equal(t, host.IPv6, stored.IPv6)
+
+	assert.Nil(t, storage.DeleteHost(ctx, "example.org", "pi"))
+	assert.Equal(t, ErrNotFound, storage.DeleteHost(ctx, "example.org", "pi"))
+	_, err = storage.GetHost(ctx, "example.org", "pi")
+	assert.Equal(t, ErrNotFound, err)
+
+	// released hosts can be registered again
+	assert.Nil(t, storage.CreateHost(ctx, host))
+}
+
+func testStorageStaleSetHost(t *testing.T, storage Storage) {
+	ctx := context.Background()
+
+	stale := &Host{Zone: "example.org", Hostname: "pi", Tokens: HostTokens{DefaultTokenName: "abc"}}
+	assert.Nil(t, storage.CreateHost(ctx, stale))
+	assert.Nil(t, storage.DeleteHost(ctx, "example.org", "pi"))
+
+	// an update of a released host must not register it again
+	assert.Equal(t, ErrNotFound, storage.SetHost(ctx, stale))
+
+	_, err := storage.GetHost(ctx, "example.org", "pi")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func testStorageUpdateHost(t *testing.T, storage Storage) {
+	ctx := context.Background()
+
+	assert.Nil(t, storage.CreateHost(ctx, &Host{Zone: "example.org", Hostname: "pi", Tokens: HostTokens{DefaultTokenName: "abc"}}))
+	serial, _ := storage.GetSerial(ctx, "example.org")
+
+	// concurrent updates are applied one after another
+	var wg sync.WaitGroup
+	errs := make([]error, MaxTXTRecords)
+
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = storage.UpdateHost(ctx, "example.org", "pi", func(host *Host) error {
+				return host.AddTXT(fmt.Sprintf("challenge%d", i))
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.Nil(t, err)
+	}
+
+	stored, err := storage.GetHost(ctx, "example.org", "pi")
+	assert.Nil(t, err)
+	assert.Len(t, stored.TXT, MaxTXTRecords)
+	assert.Equal(t, HostTokens{DefaultTokenName: "abc"}, stored.Tokens)
+
+	next, _ := storage.GetSerial(ctx, "example.org")
+	assert.True(t, next > serial)
+
+	// failed updates are not written
+	err = storage.UpdateHost(ctx, "example.org", "pi", func(host *Host) error {
+		host.RemoveTXT("challenge0")
+		return host.AddTXT("invalid value")
+	})
+	assert.EqualError(t, err, "Invalid TXT value")
+
+	stored, _ = storage.GetHost(ctx, "example.org", "pi")
+	assert.Contains(t, stored.TXT, "challenge0")
+
+	assert.Equal(t, ErrNotFound, storage.UpdateHost(ctx, "example.org", "notexisting", func(host *Host) error {
+		return nil
+	}))
+}
+
+func testStorageListHosts(t *testing.T, storage Storage) {
+	ctx := context.Background()
+
+	tokens := HostTokens{DefaultTokenName: "abc"}
+	for _, name := range []string{"e", "d", "c", "b", "a"} {
+		assert.Nil(t, storage.CreateHost(ctx, &Host{Zone: "example.org", Hostname: name, Tokens: tokens}))
+	}
+	assert.Nil(t, storage.CreateHost(ctx, &Host{Zone: "iot.example.org", Hostname: "f", Tokens: tokens}))
+
+	names := []string{}
+	cursor := ""
+	for pages := 0; pages < 100; pages++ {
+		hosts, next, err := storage.ListHosts(ctx, "example.org", cursor, 2)
+		assert.Nil(t, err)
+
+		for _, host := range hosts {
+			assert.Equal(t, "example.org", host.Zone)
+			names = append(names, host.Hostname)
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	// the order and the page size depend on the storage
+	sort.Strings(names)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, names)
+
+	hosts, next, err := storage.ListHosts(ctx, "iot.example.org", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, hosts, 1)
+	assert.Equal(t, "", next)
+
+	// a page size below one is treated as one
+	for _, count := range []int{0, -1} {
+		_, _, err = storage.ListHosts(ctx, "example.org", "", count)
+		assert.Nil(t, err)
+	}
+}
+
+func testStorageSerial(t *testing.T, storage Storage) {
+	ctx := context.Background()
+
+	serial, err := storage.GetSerial(ctx, "example.org")
+	assert.Nil(t, err)
+	assert.Equal(t, serialBase(time.Now()), serial)
+
+	host := &Host{Zone: "example.org", Hostname: "pi", IPv4: Addresses{"1.2.3.4"}}
+	assert.Nil(t, storage.CreateHost(ctx, host))
+	next, _ := storage.GetSerial(ctx, "example.org")
+	assert.Equal(t, serial+1, next)
+
+	// the serial is only incremented when the records change
+	assert.Nil(t, storage.SetHost(ctx, host))
+	next, _ = storage.GetSerial(ctx, "example.org")
+	assert.Equal(t, serial+1, next)
+
+	host.IPv6 = Addresses{"2001:db8::1"}
+	assert.Nil(t, storage.SetHost(ctx, host))
+	next, _ = storage.GetSerial(ctx, "example.org")
+	assert.Equal(t, serial+2, next)
+
+	// the serials of the zones are independent
+	other, err := storage.GetSerial(ctx, "iot.example.org")
+	assert.Nil(t, err)
+	assert.Equal(t, serialBase(time.Now()), other)
+
+	assert.Nil(t, storage.DeleteHost(ctx, "example.org", "pi"))
+	next, _ = storage.GetSerial(ctx, "example.org")
+	assert.Equal(t, serial+3, next)
+}
+
+func testStorageConcurrentCreateHost(t *testing.T, storage Storage) {
+	ctx := context.Background()
+
+	const racers = 20
+
+	var wg sync.WaitGroup
+	errs := make([]error, racers)
+	hosts := make([]*Host, racers)
+
+	for i := 0; i < racers; i++ {
+		hosts[i] = &Host{Zone: "example.org", Hostname: "pi", Tokens: HostTokens{DefaultTokenName: string(rune('a' + i))}}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = storage.CreateHost(ctx, hosts[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var winner *Host
+	for i, err := range errs {
+		if err == nil {
+			assert.Nil(t, winner, "only one registration may succeed")
+			winner = hosts[i]
+		} else {
+			assert.Equal(t, ErrHostExists, err)
+		}
+	}
+
+	if assert.NotNil(t, winner) {
+		stored, err := storage.GetHost(ctx, "example.org", "pi")
+		assert.Nil(t, err)
+		assert.Equal(t, winner.Tokens, stored.Tokens)
+	}
+}
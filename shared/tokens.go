@@ -0,0 +1,119 @@
+package shared
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultTokenName is the name of the token that is created with a host
+const DefaultTokenName = "default"
+
+// MaxTokens is the number of named tokens a host can have
+const MaxTokens = 8
+
+var validTokenName = regexp.MustCompile("^[a-zA-Z0-9_\\-]{1,32}$")
+
+// HostTokens maps the names of the tokens of a host to their hashes
+type HostTokens map[string]string
+
+// Names returns the sorted names of the tokens
+func (t HostTokens) Names() []string {
+	names := []string{}
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// GenerateAndSetToken generates a random token with the supplied name, which
+// replaces an existing token of the same name. The token starts with its name
+// like router.<secret>, so that only the hash of this token has to be checked.
+// Only the hash of the secret is stored in the host, so that the returned token
+// has to be passed to the owner.
+func (h *Host) GenerateAndSetToken(name string) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	secret := hex.EncodeToString(random)
+	if err := h.SetToken(name, secret); err != nil {
+		return "", err
+	}
+
+	return name + "." + secret, nil
+}
+
+// SetToken stores the salted hash of the token under the supplied name
+func (h *Host) SetToken(name, token string) error {
+	if !validTokenName.MatchString(name) {
+		return errors.New("Invalid token name")
+	}
+
+	if _, exists := h.Tokens[name]; !exists && len(h.Tokens) >= MaxTokens {
+		return errors.New("Too many tokens")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	if h.Tokens == nil {
+		h.Tokens = HostTokens{}
+	}
+
+	h.Tokens[name] = string(hash)
+	return nil
+}
+
+// RevokeToken removes the token with the supplied name. The last token cannot
+// be revoked, because the host could not be managed anymore.
+func (h *Host) RevokeToken(name string) error {
+	if _, exists := h.Tokens[name]; !exists {
+		return errors.New("Token does not exist")
+	}
+
+	if len(h.Tokens) == 1 {
+		return errors.New("The last token of a host cannot be revoked")
+	}
+
+	delete(h.Tokens, name)
+	return nil
+}
+
+// CheckToken returns the name of the token if it is valid for the host. Only
+// the token named by the prefix of the token is checked, where tokens without
+// a prefix are default tokens issued before tokens had names. Hosts created
+// before tokens have been hashed contain the token in plain text, which is
+// replaced by its hash after the first successful check, so that the host has
+// to be stored afterwards.
+func (h *Host) CheckToken(token string) (string, bool) {
+	name, secret := DefaultTokenName, token
+	if dot := strings.Index(token, "."); dot >= 0 {
+		name, secret = token[:dot], token[dot+1:]
+	}
+
+	hash, exists := h.Tokens[name]
+	if !exists || hash == "" || secret == "" {
+		return "", false
+	}
+
+	if strings.HasPrefix(hash, "$2") {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil {
+			return name, true
+		}
+	} else if subtle.ConstantTimeCompare([]byte(hash), []byte(secret)) == 1 {
+		return name, h.SetToken(name, secret) == nil
+	}
+
+	return "", false
+}